@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TAlertRule is a threshold on a stat counter: <field><op><value>[%|x].
+// With % the counter is taken as a percent of the domains, with x as the
+// ratio to the previous pass (a previous zero counts as one).
+type TAlertRule struct {
+	Rule  string
+	Field string
+	Op    string
+	Value float64
+	Unit  string
+}
+
+type TAlert struct {
+	Rule      string  `json:"rule"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+}
+
+type TAlertEvent struct {
+	Name   string        `json:"name,omitempty"`
+	T      int64         `json:"t"`
+	Alerts []TAlert      `json:"alerts"`
+	Stat   *TResolveStat `json:"stat"`
+}
+
+// TAlerts evaluates the rules after every pass and notifies the webhook
+// and/or runs the command when some of them fire.
+type TAlerts struct {
+	Rules   []TAlertRule
+	Webhook string
+	Key     string
+	Command string
+	Timeout time.Duration
+	Dir     string
+}
+
+// CAlertEnv prefixes the variables the alert command is given, no key
+// has an environment variable starting with it.
+const CAlertEnv = "RVZ_ALERT_"
+
+var alertOps = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// statValues returns the numeric counters of the stat by their json names.
+func statValues(stat *TResolveStat) map[string]float64 {
+	res := make(map[string]float64)
+	dat, err := json.Marshal(stat)
+	if err != nil {
+		return res
+	}
+	var m map[string]interface{}
+	json.Unmarshal(dat, &m)
+	for k, v := range m {
+		if f, ok := v.(float64); ok {
+			res[k] = f
+		}
+	}
+	return res
+}
+
+// ParseAlertRules reads the rules separated by semicolons.
+func ParseAlertRules(s string) ([]TAlertRule, error) {
+	var rules []TAlertRule
+	known := statValues(&TResolveStat{})
+	for _, r := range strings.Split(s, ";") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		rule := TAlertRule{Rule: r}
+		for _, op := range alertOps {
+			if i := strings.Index(r, op); i > 0 {
+				rule.Field, rule.Op = strings.TrimSpace(r[:i]), op
+				r = strings.TrimSpace(r[i+len(op):])
+				break
+			}
+		}
+		if rule.Op == "" {
+			return nil, fmt.Errorf("Alert rule %s: no operator", rule.Rule)
+		}
+		if _, ok := known[rule.Field]; !ok {
+			return nil, fmt.Errorf("Alert rule %s: unknown counter %s", rule.Rule, rule.Field)
+		}
+		if strings.HasSuffix(r, "%") || strings.HasSuffix(r, "x") {
+			rule.Unit, r = r[len(r)-1:], r[:len(r)-1]
+		}
+		v, err := strconv.ParseFloat(r, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Alert rule %s: not valid value", rule.Rule)
+		}
+		rule.Value = v
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r *TAlertRule) compare(v float64) bool {
+	switch r.Op {
+	case ">":
+		return v > r.Value
+	case ">=":
+		return v >= r.Value
+	case "<":
+		return v < r.Value
+	case "<=":
+		return v <= r.Value
+	case "==":
+		return v == r.Value
+	}
+	return v != r.Value
+}
+
+// Evaluate returns the rules firing for the stat, prev is nil on the first
+// pass and the ratio rules are skipped.
+func (a *TAlerts) Evaluate(stat, prev *TResolveStat) []TAlert {
+	var res []TAlert
+	cur := statValues(stat)
+	var _prev map[string]float64
+	if prev != nil {
+		_prev = statValues(prev)
+	}
+	for _, r := range a.Rules {
+		v := cur[r.Field]
+		switch r.Unit {
+		case "%":
+			if cur["domains"] == 0 {
+				continue
+			}
+			v = v * 100 / cur["domains"]
+		case "x":
+			if _prev == nil {
+				continue
+			}
+			p := _prev[r.Field]
+			if p == 0 {
+				p = 1
+			}
+			v = v / p
+		}
+		if r.compare(v) {
+			res = append(res, TAlert{Rule: r.Rule, Value: v, Threshold: r.Value})
+		}
+	}
+	return res
+}
+
+func (a *TAlerts) stateFile(name string) string {
+	if name == "" {
+		return fmt.Sprintf("%s/laststat.json", a.Dir)
+	}
+	return fmt.Sprintf("%s/laststat-%s.json", a.Dir, name)
+}
+
+// Check evaluates the rules against the previous pass of the same name,
+// notifies and keeps the stat for the next pass.
+func (a *TAlerts) Check(name string, t int64, stat *TResolveStat) {
+	if a == nil || len(a.Rules) == 0 {
+		return
+	}
+	var prev *TResolveStat
+	if dat, err := ioutil.ReadFile(a.stateFile(name)); err == nil {
+		if json.Unmarshal(dat, &prev) != nil {
+			prev = nil
+		}
+	}
+	if dat, err := json.Marshal(stat); err == nil {
+		err = writeLines(a.stateFile(name), func(w *bufio.Writer) {
+			w.Write(dat)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Can't save alert state: %s\n", err.Error())
+		}
+	}
+	alerts := a.Evaluate(stat, prev)
+	if len(alerts) == 0 {
+		return
+	}
+	for _, _a := range alerts {
+		fmt.Fprintf(os.Stderr, "Alert: %s (%g)\n", _a.Rule, _a.Value)
+	}
+	if err := a.Notify(&TAlertEvent{Name: name, T: t, Alerts: alerts, Stat: stat}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Can't notify alerts: %s\n", err.Error())
+	}
+}
+
+// alertEnv is the environment of the alert command: the one of the
+// daemon without the RVZ_ variables, which may carry keys, plus the fired
+// rules and the name of the pass.
+func alertEnv(e *TAlertEvent) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "RVZ_") {
+			env = append(env, kv)
+		}
+	}
+	rules := make([]string, len(e.Alerts))
+	for i, _a := range e.Alerts {
+		rules[i] = _a.Rule
+	}
+	return append(env, CAlertEnv+"RULES="+strings.Join(rules, ";"), CAlertEnv+"PASS="+e.Name)
+}
+
+// Notify posts the event to the webhook and passes it to the command on
+// stdin, with the fired rules in RVZ_ALERT_RULES and the pass name in
+// RVZ_ALERT_PASS.
+func (a *TAlerts) Notify(e *TAlertEvent) error {
+	dat, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	if a.Webhook != "" {
+		s := &TSink{Key: a.Key, Retries: 2, Backoff: time.Second, Timeout: a.Timeout}
+		if err := s.send(TSinkRequest{URL: a.Webhook, ContentType: "application/json"}, bytesBody(dat)); err != nil {
+			errs = append(errs, fmt.Sprintf("webhook: %s", err.Error()))
+		}
+	}
+	if a.Command != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), a.Timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, a.Command)
+		cmd.Stdin = bytes.NewReader(dat)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = alertEnv(e)
+		if err := cmd.Run(); err != nil {
+			errs = append(errs, fmt.Sprintf("command: %s", err.Error()))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseAlertRules(t *testing.T) {
+	rules, err := ParseAlertRules(" errors>5%; servfail >= 3x;domains==0;;nxdomain!=1.5 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TAlertRule{
+		{"errors>5%", "errors", ">", 5, "%"},
+		{"servfail >= 3x", "servfail", ">=", 3, "x"},
+		{"domains==0", "domains", "==", 0, ""},
+		{"nxdomain!=1.5", "nxdomain", "!=", 1.5, ""},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules %+v\nwant %+v", rules, want)
+	}
+	if rules, err := ParseAlertRules(""); err != nil || len(rules) != 0 {
+		t.Errorf("no rules: %v %v", rules, err)
+	}
+	for _, s := range []string{"errors", ">5", "bogus>1", "home==RU", "errors>many", "errors>5%x", "errors>5;drift"} {
+		if _, err := ParseAlertRules(s); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
+
+func testAlerts(t *testing.T, rules string) *TAlerts {
+	t.Helper()
+	_rules, err := ParseAlertRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &TAlerts{Rules: _rules, Timeout: 5 * time.Second, Dir: t.TempDir()}
+}
+
+func TestAlertEvaluate(t *testing.T) {
+	a := testAlerts(t, "errors>5%;servfail>=3x;domains==0;drift<1;nxdomain!=0")
+	for _, c := range []struct {
+		name       string
+		stat, prev *TResolveStat
+		want       []TAlert
+	}{
+		{"quiet", &TResolveStat{Domains: 100, Errors: 5, Fail: 2, Drift: 1}, &TResolveStat{Fail: 1}, nil},
+		{"percent", &TResolveStat{Domains: 200, Errors: 11, Drift: 1}, nil,
+			[]TAlert{{"errors>5%", 5.5, 5}}},
+		{"ratio", &TResolveStat{Domains: 100, Fail: 9, Drift: 1}, &TResolveStat{Fail: 3},
+			[]TAlert{{"servfail>=3x", 3, 3}}},
+		{"ratio to zero", &TResolveStat{Domains: 100, Fail: 4, Drift: 1}, &TResolveStat{},
+			[]TAlert{{"servfail>=3x", 4, 3}}},
+		{"first pass", &TResolveStat{Domains: 100, Fail: 40, Drift: 1}, nil, nil},
+		{"empty", &TResolveStat{}, &TResolveStat{Domains: 100},
+			[]TAlert{{"domains==0", 0, 0}, {"drift<1", 0, 1}}},
+		{"not equal", &TResolveStat{Domains: 100, Drift: 1, Nx: 3}, nil,
+			[]TAlert{{"nxdomain!=0", 3, 0}}},
+	} {
+		if got := a.Evaluate(c.stat, c.prev); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+// talertServer keeps the events posted to it.
+type talertServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	events []TAlertEvent
+}
+
+func newAlertServer(t *testing.T) *talertServer {
+	srv := &talertServer{}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e TAlertEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("event %v, authorization %q", err, r.Header.Get("Authorization"))
+		}
+		srv.mu.Lock()
+		srv.events = append(srv.events, e)
+		srv.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (srv *talertServer) result() []TAlertEvent {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]TAlertEvent{}, srv.events...)
+}
+
+func TestAlertCheck(t *testing.T) {
+	srv := newAlertServer(t)
+	a := testAlerts(t, "servfail>=3x")
+	a.Webhook, a.Key = srv.URL, "secret"
+	a.Check("", 1000, &TResolveStat{Domains: 10, Fail: 2})
+	a.Check("urgent", 1001, &TResolveStat{Domains: 1, Fail: 20})
+	// Each pass is compared with the previous one of its name.
+	a.Check("", 2000, &TResolveStat{Domains: 10, Fail: 6})
+	a.Check("urgent", 2001, &TResolveStat{Domains: 1, Fail: 30})
+	events := srv.result()
+	if len(events) != 1 || events[0].T != 2000 || events[0].Name != "" || events[0].Stat.Fail != 6 ||
+		!reflect.DeepEqual(events[0].Alerts, []TAlert{{"servfail>=3x", 3, 3}}) {
+		t.Errorf("events %+v", events)
+	}
+	for _, name := range []string{"laststat.json", "laststat-urgent.json"} {
+		if _, err := os.Stat(filepath.Join(a.Dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	// Without rules nothing is kept.
+	(&TAlerts{Dir: a.Dir}).Check("full", 3000, &TResolveStat{})
+	if _, err := os.Stat(filepath.Join(a.Dir, "laststat-full.json")); err == nil {
+		t.Error("state kept without rules")
+	}
+}
+
+func TestAlertWebhookFail(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	a := testAlerts(t, "domains==0")
+	a.Webhook = srv.URL
+	if err := a.Notify(&TAlertEvent{T: 1000}); err == nil || !strings.Contains(err.Error(), "webhook") {
+		t.Errorf("webhook error %v", err)
+	}
+}
+
+func TestAlertCommand(t *testing.T) {
+	dir := t.TempDir()
+	command := filepath.Join(dir, "page.sh")
+	script := "#!/bin/sh\nenv >" + filepath.Join(dir, "env") + "\ncat >" + filepath.Join(dir, "stdin") + "\n"
+	if err := ioutil.WriteFile(command, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RVZ_APIKEY", "apikey")
+	t.Setenv("RVZ_SINKKEY", "sinkkey")
+	t.Setenv("ALERT_TEST_OTHER", "kept")
+	a := testAlerts(t, "errors>5%;domains==0")
+	a.Command = command
+	e := &TAlertEvent{Name: "urgent", T: 1000, Alerts: []TAlert{{"errors>5%", 10, 5}, {"domains==0", 0, 0}}, Stat: &TResolveStat{}}
+	if err := a.Notify(e); err != nil {
+		t.Fatal(err)
+	}
+	// The keys in RVZ_ variables are not passed on, the rest is.
+	env := make(map[string]string)
+	for _, kv := range strings.Split(readFile(t, filepath.Join(dir, "env")), "\n") {
+		if kv := strings.SplitN(kv, "=", 2); len(kv) == 2 && (strings.HasPrefix(kv[0], "RVZ_") || kv[0] == "ALERT_TEST_OTHER") {
+			env[kv[0]] = kv[1]
+		}
+	}
+	want := map[string]string{"RVZ_ALERT_RULES": "errors>5%;domains==0", "RVZ_ALERT_PASS": "urgent", "ALERT_TEST_OTHER": "kept"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("command environment %v, want %v", env, want)
+	}
+	var _e TAlertEvent
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(dir, "stdin"))), &_e); err != nil || !reflect.DeepEqual(_e.Alerts, e.Alerts) {
+		t.Errorf("command stdin %+v %v", _e, err)
+	}
+
+	a.Command = filepath.Join(dir, "missing.sh")
+	if err := a.Notify(e); err == nil || !strings.Contains(err.Error(), "command") {
+		t.Errorf("missing command: %v", err)
+	}
+	if err := ioutil.WriteFile(command, []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	a.Command, a.Timeout = command, 100*time.Millisecond
+	start := time.Now()
+	if err := a.Notify(e); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("command past the timeout: %v after %s", err, time.Since(start))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/net/idna"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// TAllowList holds domain suffixes and address ranges which are never
+// resolved nor exported.
+type TAllowList struct {
+	domains map[string]bool
+	nets    []netip.Prefix
+}
+
+// ReadAllowList reads the allowlist file: one domain suffix, address or
+// CIDR per line, # starts a comment.
+func ReadAllowList(filename string) (*TAllowList, error) {
+	a := &TAllowList{domains: make(map[string]bool)}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(line); err == nil || strings.Contains(line, "/") {
+			p, err := ParsePrefixes([]string{line})
+			if err != nil {
+				return nil, fmt.Errorf("Allowlist line %d invalid: %s (%s)", l, line, err.Error())
+			}
+			a.nets = append(a.nets, p...)
+			continue
+		}
+		domain := strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(line), "*."), ".")
+		domain, err = idna.ToASCII(domain)
+		if err != nil || !isDomainName(domain) {
+			return nil, fmt.Errorf("Allowlist line %d invalid: %s (not a domain)", l, line)
+		}
+		a.domains[domain] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// MatchDomain reports whether the domain or one of its parents is listed.
+func (a *TAllowList) MatchDomain(domain string) bool {
+	if a == nil {
+		return false
+	}
+	domain = strings.TrimSuffix(domain, ".")
+	for {
+		if a.domains[domain] {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// MatchIP reports whether the address falls into one of the listed ranges.
+func (a *TAllowList) MatchIP(ip string) bool {
+	if a == nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return prefixesContain(a.nets, addr.Unmap())
+}
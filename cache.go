@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	CCacheOff    string = "off"
+	CCacheMemory string = "memory"
+	CCacheDisk   string = "disk"
+)
+
+type TCacheEntry struct {
+	Msg    []byte `json:"m"`
+	Stored int64  `json:"s"`
+	Expire int64  `json:"e"`
+}
+
+// TCache keeps the answers between passes for as long as their TTL (or
+// the SOA minimum of negative answers) allows.
+type TCache struct {
+	mu      sync.Mutex
+	entries map[string]TCacheEntry
+	file    string
+	maxttl  uint32
+	hits    uint
+	misses  uint
+}
+
+// NewCache returns an empty cache, or the one saved in file if it is set.
+func NewCache(file string, maxttl uint32) (*TCache, error) {
+	c := &TCache{entries: make(map[string]TCacheEntry), file: file, maxttl: maxttl}
+	if file == "" {
+		return c, nil
+	}
+	if _, err := os.Stat(file); err != nil {
+		return c, nil
+	}
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return c, err
+	}
+	if err = json.Unmarshal(dat, &c.entries); err != nil {
+		c.entries = make(map[string]TCacheEntry)
+		return c, err
+	}
+	return c, nil
+}
+
+func cacheKey(domain string, qtype uint16) string {
+	return fmt.Sprintf("%s/%s", dns.Fqdn(domain), dns.TypeToString[qtype])
+}
+
+// cacheTTL is the minimum answer TTL of a positive answer or the negative
+// TTL of an NXDOMAIN/NODATA one (RFC 2308), ok is false when the answer
+// must not be cached.
+func cacheTTL(r *dns.Msg) (ttl uint32, ok bool) {
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return 0, false
+	}
+	if r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0 {
+		for i, rr := range r.Answer {
+			if i == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return ttl, true
+	}
+	for _, rr := range r.Ns {
+		if soa, _ok := rr.(*dns.SOA); _ok {
+			ttl = soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+// Get returns a not yet expired answer with its TTLs decreased by the time
+// it spent in the cache.
+func (c *TCache) Get(domain string, qtype uint16) (*dns.Msg, bool) {
+	if c == nil {
+		return nil, false
+	}
+	now := time.Now().Unix()
+	c.mu.Lock()
+	e, ok := c.entries[cacheKey(domain, qtype)]
+	if !ok || e.Expire <= now {
+		c.misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.mu.Unlock()
+	r := new(dns.Msg)
+	err := r.Unpack(e.Msg)
+	c.mu.Lock()
+	if err != nil {
+		// A corrupt entry (e.g. a damaged cache file) is a miss and is
+		// dropped unless it was replaced meanwhile.
+		c.misses++
+		if _e, _ok := c.entries[cacheKey(domain, qtype)]; _ok && _e.Stored == e.Stored && _e.Expire == e.Expire {
+			delete(c.entries, cacheKey(domain, qtype))
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.hits++
+	c.mu.Unlock()
+	elapsed := uint32(now - e.Stored)
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return r, true
+}
+
+func (c *TCache) Put(domain string, qtype uint16, r *dns.Msg) {
+	if c == nil || r == nil {
+		return
+	}
+	ttl, ok := cacheTTL(r)
+	if !ok || ttl == 0 {
+		return
+	}
+	if c.maxttl > 0 && ttl > c.maxttl {
+		ttl = c.maxttl
+	}
+	dat, err := r.Pack()
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	c.mu.Lock()
+	c.entries[cacheKey(domain, qtype)] = TCacheEntry{Msg: dat, Stored: now, Expire: now + int64(ttl)}
+	c.mu.Unlock()
+}
+
+// Stat adds the cache counters of the pass to the statistics and resets
+// them.
+func (c *TCache) Stat(stat *TResolveStat) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stat.CacheHit, stat.CacheMiss = c.hits, c.misses
+	c.hits, c.misses = 0, 0
+}
+
+// Clear drops every entry, the file is emptied by the next Save.
+func (c *TCache) Clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.entries = make(map[string]TCacheEntry)
+	c.mu.Unlock()
+}
+
+// Save drops the expired entries and writes the cache to its file.
+func (c *TCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	now := time.Now().Unix()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if e.Expire <= now {
+			delete(c.entries, k)
+		}
+	}
+	if c.file == "" {
+		return nil
+	}
+	dat, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	return writeLines(c.file, func(w *bufio.Writer) {
+		w.Write(dat)
+	})
+}
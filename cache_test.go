@@ -0,0 +1,105 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func testAnswer(t *testing.T, domain string, rrs ...string) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	m.Response = true
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestCacheHit(t *testing.T) {
+	c, _ := NewCache("", 0)
+	if _, ok := c.Get("example.com", dns.TypeA); ok {
+		t.Fatal("hit in an empty cache")
+	}
+	c.Put("example.com", dns.TypeA, testAnswer(t, "example.com", "example.com. 300 IN A 192.0.2.1"))
+	r, ok := c.Get("example.com", dns.TypeA)
+	if !ok || len(r.Answer) != 1 || r.Answer[0].Header().Ttl > 300 {
+		t.Fatalf("got %v %v", r, ok)
+	}
+	if _, ok := c.Get("example.com", dns.TypeAAAA); ok {
+		t.Fatal("hit of another qtype")
+	}
+	stat := &TResolveStat{}
+	c.Stat(stat)
+	if stat.CacheHit != 1 || stat.CacheMiss != 2 {
+		t.Errorf("hit %d miss %d, want 1 and 2", stat.CacheHit, stat.CacheMiss)
+	}
+}
+
+func TestCacheCorrupt(t *testing.T) {
+	c, _ := NewCache("", 0)
+	c.Put("example.com", dns.TypeA, testAnswer(t, "example.com", "example.com. 300 IN A 192.0.2.1"))
+	key := cacheKey("example.com", dns.TypeA)
+	e := c.entries[key]
+	e.Msg = e.Msg[:len(e.Msg)-3]
+	c.entries[key] = e
+	if _, ok := c.Get("example.com", dns.TypeA); ok {
+		t.Fatal("hit of a corrupt entry")
+	}
+	if _, ok := c.entries[key]; ok {
+		t.Error("corrupt entry is not evicted")
+	}
+	stat := &TResolveStat{}
+	c.Stat(stat)
+	if stat.CacheHit != 0 || stat.CacheMiss != 1 {
+		t.Errorf("hit %d miss %d, want 0 and 1", stat.CacheHit, stat.CacheMiss)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c, _ := NewCache("", 60)
+	c.Put("zero.example", dns.TypeA, testAnswer(t, "zero.example", "zero.example. 0 IN A 192.0.2.1"))
+	if _, ok := c.entries[cacheKey("zero.example", dns.TypeA)]; ok {
+		t.Error("zero TTL answer is cached")
+	}
+	c.Put("long.example", dns.TypeA, testAnswer(t, "long.example", "long.example. 86400 IN A 192.0.2.1"))
+	if e := c.entries[cacheKey("long.example", dns.TypeA)]; e.Expire-e.Stored != 60 {
+		t.Errorf("cached for %d, want maxttl 60", e.Expire-e.Stored)
+	}
+	nx := testAnswer(t, "nx.example")
+	nx.Rcode = dns.RcodeNameError
+	soa, _ := dns.NewRR("example. 3600 IN SOA ns.example. root.example. 1 7200 900 1209600 30")
+	nx.Ns = append(nx.Ns, soa)
+	c.Put("nx.example", dns.TypeA, nx)
+	if e := c.entries[cacheKey("nx.example", dns.TypeA)]; e.Expire-e.Stored != 30 {
+		t.Errorf("NXDOMAIN cached for %d, want SOA minimum 30", e.Expire-e.Stored)
+	}
+	fail := testAnswer(t, "fail.example")
+	fail.Rcode = dns.RcodeServerFailure
+	c.Put("fail.example", dns.TypeA, fail)
+	if _, ok := c.entries[cacheKey("fail.example", dns.TypeA)]; ok {
+		t.Error("SERVFAIL is cached")
+	}
+}
+
+func TestCacheSave(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dnscache.json")
+	c, _ := NewCache(file, 0)
+	c.Put("example.com", dns.TypeA, testAnswer(t, "example.com", "example.com. 300 IN A 192.0.2.1"))
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCache(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("example.com", dns.TypeA); !ok {
+		t.Error("saved entry is lost")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// RunCommand runs the subcommand given after the flags and returns the exit
+// code.
+func RunCommand(args []string) int {
+	var err error
+	switch args[0] {
+	case "query":
+		err = cmdQuery(args[1:])
+	case "ip":
+		err = cmdIP(args[1:])
+	case "shared":
+		err = cmdShared(args[1:])
+	case "validate":
+		err = cmdValidate(args[1:])
+	case "export":
+		err = cmdExport(args[1:])
+	default:
+		err = fmt.Errorf("Unknown command: %s", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+func cmdQuery(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	domain := fs.String("domain", "", "Domain to show the history of")
+	ip := fs.String("ip", "", "IP address to show the domains of")
+	_from := fs.String("from", "", "Start of the time range (unix time, YYYY-MM-DD or RFC 3339)")
+	_to := fs.String("to", "", "End of the time range")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	from, err := ParseTime(*_from)
+	if err != nil {
+		return err
+	}
+	to, err := ParseTime(*_to)
+	if err != nil {
+		return err
+	}
+	if ConfErr != nil {
+		return ConfErr
+	}
+	if Conf.Store == "" {
+		return fmt.Errorf("No store configured")
+	}
+	return StoreQuery(Conf.Store, *domain, *ip, from, to)
+}
+
+func ipIndexFile(name string) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+	if ConfErr != nil {
+		return "", ConfErr
+	}
+	return fmt.Sprintf("%s/ipindex.json", Conf.Workdir), nil
+}
+
+func cmdIP(args []string) error {
+	fs := flag.NewFlagSet("ip", flag.ContinueOnError)
+	index := fs.String("index", "", "IP index file (default workdir/ipindex.json)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("IP address is required")
+	}
+	filename, err := ipIndexFile(*index)
+	if err != nil {
+		return err
+	}
+	idx, err := ReadIPIndex(filename)
+	if err != nil {
+		return err
+	}
+	want := make(map[string]bool)
+	for _, ip := range fs.Args() {
+		want[ip] = true
+	}
+	for _, e := range idx.List {
+		if want[e.Ip] {
+			printIPIndexEntry(e, true)
+			delete(want, e.Ip)
+		}
+	}
+	for ip := range want {
+		fmt.Fprintf(os.Stderr, "Not found: %s\n", ip)
+	}
+	return nil
+}
+
+func cmdShared(args []string) error {
+	fs := flag.NewFlagSet("shared", flag.ContinueOnError)
+	index := fs.String("index", "", "IP index file (default workdir/ipindex.json)")
+	min := fs.Int("min", 2, "Minimum number of domains on the address")
+	top := fs.Int("top", 50, "Number of addresses to show, 0 for all")
+	full := fs.Bool("domains", false, "Show the domains")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	filename, err := ipIndexFile(*index)
+	if err != nil {
+		return err
+	}
+	idx, err := ReadIPIndex(filename)
+	if err != nil {
+		return err
+	}
+	for i, e := range idx.List {
+		if (*top > 0 && i >= *top) || len(e.Domains) < *min {
+			break
+		}
+		printIPIndexEntry(e, *full)
+	}
+	return nil
+}
+
+// openResult opens a result file, snapshots are read through gzip.
+func openResult(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+func cmdValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	_schema := fs.String("schema", "", "Schema file (default the built-in result schema)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("Result file is required")
+	}
+	dat := ResultSchema
+	if *_schema != "" {
+		var err error
+		if dat, err = ioutil.ReadFile(*_schema); err != nil {
+			return err
+		}
+	}
+	schema, err := ParseSchema(dat)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, filename := range fs.Args() {
+		r, err := openResult(filename)
+		if err != nil {
+			return err
+		}
+		n, err := ValidateResult(r, schema)
+		r.Close()
+		if err != nil {
+			fmt.Printf("%s: invalid after %d entries: %s\n", filename, n, err.Error())
+			failed++
+			continue
+		}
+		fmt.Printf("%s: valid, %d entries\n", filename, n)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files are not valid", failed, fs.NArg())
+	}
+	return nil
+}
+
+func cmdExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", CExportCsv, "Table format: csv or parquet")
+	dir := fs.String("dir", ".", "Directory to write the tables to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("Result file is required")
+	}
+	for _, filename := range fs.Args() {
+		n, err := ExportResult(filename, *dir, *format)
+		if err != nil {
+			return fmt.Errorf("%s: %s", filename, err.Error())
+		}
+		fmt.Printf("%s: %d domains exported\n", filename, n)
+	}
+	return nil
+}
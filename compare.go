@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/miekg/dns"
+	"reflect"
+	"sort"
+)
+
+// TCompareAnswer is what a profile answered for a domain.
+type TCompareAnswer struct {
+	Rcode   string   `json:"rc,omitempty"`
+	Error   bool     `json:"err,omitempty"`
+	Ip4     []string `json:"ip4,omitempty"`
+	Ip6     []string `json:"ip6,omitempty"`
+	Verdict string   `json:"vd,omitempty"`
+}
+
+// TCompareDomain is a domain some profile answered differently from the
+// first one.
+type TCompareDomain struct {
+	Domain  string                    `json:"d"`
+	Answers map[string]TCompareAnswer `json:"answers"`
+}
+
+// TCompare collects the domains the profiles don't agree on, every profile
+// is compared with the first one on the query types both ask. The allowed
+// domains are not resolved and not compared.
+type TCompare struct {
+	profiles []*TProfile
+	Profiles []string         `json:"profiles"`
+	Domains  uint             `json:"domains"`
+	Differ   uint             `json:"differ"`
+	DifferBy map[string]uint  `json:"differ_by"`
+	List     []TCompareDomain `json:"list"`
+}
+
+func NewCompare(profiles []*TProfile) *TCompare {
+	c := &TCompare{profiles: profiles, DifferBy: make(map[string]uint), List: make([]TCompareDomain, 0)}
+	for _, p := range profiles {
+		c.Profiles = append(c.Profiles, p.Name)
+		c.DifferBy[p.Name] = 0
+	}
+	delete(c.DifferBy, profiles[0].Name)
+	return c
+}
+
+func compareAnswer(dinfo *TDomainInfo) TCompareAnswer {
+	a := TCompareAnswer{Rcode: dinfo.Rcode, Error: dinfo.Error, Verdict: dinfo.Verdict}
+	if len(dinfo.Ip4) > 0 {
+		a.Ip4 = append([]string{}, dinfo.Ip4...)
+		sort.Strings(a.Ip4)
+	}
+	if len(dinfo.Ip6) > 0 {
+		a.Ip6 = append([]string{}, dinfo.Ip6...)
+		sort.Strings(a.Ip6)
+	}
+	return a
+}
+
+// common keeps the addresses of the query types both profiles ask and
+// drops the verdict.
+func (a TCompareAnswer) common(p, ref *TProfile) TCompareAnswer {
+	a.Verdict = ""
+	if !p.Query(dns.TypeA) || !ref.Query(dns.TypeA) {
+		a.Ip4 = nil
+	}
+	if !p.Query(dns.TypeAAAA) || !ref.Query(dns.TypeAAAA) {
+		a.Ip6 = nil
+	}
+	return a
+}
+
+// Add compares the answers of a domain, list has one entry per profile.
+func (c *TCompare) Add(list []*TDomainInfo) {
+	if c == nil || list[0].Allowed {
+		return
+	}
+	c.Domains++
+	ref := compareAnswer(list[0])
+	differ := false
+	answers := map[string]TCompareAnswer{c.Profiles[0]: ref}
+	for i, dinfo := range list[1:] {
+		a := compareAnswer(dinfo)
+		answers[c.Profiles[i+1]] = a
+		p := c.profiles[i+1]
+		if !reflect.DeepEqual(a.common(p, c.profiles[0]), ref.common(p, c.profiles[0])) {
+			differ = true
+			c.DifferBy[c.Profiles[i+1]]++
+		}
+	}
+	if differ {
+		c.Differ++
+		c.List = append(c.List, TCompareDomain{list[0].Domain, answers})
+	}
+}
+
+// Write writes the comparison report of the pass.
+func (c *TCompare) Write(filename string, t int64, header *TDumpAnswer) error {
+	sort.Slice(c.List, func(i, j int) bool { return c.List[i].Domain < c.List[j].Domain })
+	res, err := json.MarshalIndent(struct {
+		T int64        `json:"t"`
+		H *TDumpAnswer `json:"h"`
+		*TCompare
+	}{t, header, c}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeLines(filename, func(w *bufio.Writer) {
+		w.Write(res)
+		w.WriteString("\n")
+	})
+}
@@ -10,7 +10,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
-	"strconv"
+	"sort"
 	"strings"
 )
 
@@ -83,48 +83,42 @@ func ReadConfigFile(file string) (c *Config, err error) {
 	return
 }
 
-// GetString reads a string value from the parsed config file and
-// return it (or if it is missing then return the default value passed
-// in d)
-func (c *Config) GetString(k string, d string) (v string) {
+// Lookup returns the value of the key and the line it was found at, the
+// key is marked as read.
+func (c *Config) Lookup(k string) (v string, l int, ok bool) {
 	s, present := c.v[k]
 	if !present {
-		v = d
-	} else {
-		v = s.s
-		s.r = true
-		c.v[k] = s
+		return
 	}
-	return
+	s.r = true
+	c.v[k] = s
+	return s.s, s.l, true
 }
 
-// GetUint reads an unsigned integer from the parsed config file and
+// GetString reads a string value from the parsed config file and
 // return it (or if it is missing then return the default value passed
 // in d)
-func (c *Config) GetUint(k string, d uint) (v uint) {
-	if s, present := c.v[k]; !present {
+func (c *Config) GetString(k string, d string) (v string) {
+	v, _, ok := c.Lookup(k)
+	if !ok {
 		v = d
-	} else {
-		s.r = true
-		c.v[k] = s
-		if iv, err := strconv.Atoi(s.s); err != nil {
-			v = d
-		} else {
-			v = uint(iv)
-		}
 	}
-
 	return
 }
 
 // CheckUnread checks to see if any of the parameters in the file
 // have not been read and returns a string containing those that have
-// not been read.
+// not been read, in the order of the file.
 func (c *Config) CheckUnread() (s string) {
+	var unread []string
 	for k, v := range c.v {
 		if !v.r {
-			s += fmt.Sprintf("%s (%d) ", k, v.l)
+			unread = append(unread, k)
 		}
 	}
-	return
+	sort.Slice(unread, func(i, j int) bool { return c.v[unread[i]].l < c.v[unread[j]].l })
+	for _, k := range unread {
+		s += fmt.Sprintf("%s (%d) ", k, c.v[k].l)
+	}
+	return strings.TrimSpace(s)
 }
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TConfig is the typed configuration. The conf tag is the key of the
+// config file, default its value when the key is missing ({key} is the
+// value of a key declared before). Validate checks the other tags:
+// required, min, max, oneof (values separated by |) and path (file, dir or
+// parent, checked when the key is set).
+//
+// Every key can be given as a flag (-key value), in the environment
+// (RVZ_KEY) or in the file, in this order of precedence. APIKey is read
+// from apikeyfile unless it is given as a flag or in the environment. An
+// RVZ_ variable that is not a key is an error like an unknown key.
+//
+// Every name of profiles reads its TProfileConfig from the keys
+// profile.<name>.<key> (RVZ_PROFILE_<NAME>_<KEY> in the environment).
+//
+// The keys tagged reload:"no" keep their value when the config is
+// reloaded on SIGHUP.
+type TConfig struct {
+	APIURL     string `conf:"APIURL" default:"https://proxy-01.eais-upload.451f.cc"`
+	APIKey     string `conf:"APIKey" required:"1"`
+	APIKeyFile string `conf:"apikeyfile" path:"file"`
+	Workdir    string `conf:"workdir" default:"/tmp" path:"dir" reload:"no"`
+	Results    string `conf:"results" default:"/tmp" path:"dir" reload:"no"`
+
+	MmdbFile     string `conf:"mmdbfile" default:"{workdir}/GeoLite2-Country.mmdb" path:"file"`
+	CityMmdbFile string `conf:"citymmdbfile" path:"file"`
+	AsnMmdbFile  string `conf:"asnmmdbfile" path:"file"`
+	HomeCountry  string `conf:"homecountry" default:"RU"`
+	TopN         uint   `conf:"topn" default:"10"`
+
+	DnsHost    string `conf:"dnshost" default:"127.0.0.1"`
+	DnsPort    uint   `conf:"dnsport" default:"53" min:"1" max:"65535"`
+	MaxPool    uint   `conf:"maxpool" default:"100"`
+	NextPool   uint   `conf:"nextpool" default:"80"`
+	Workers    uint   `conf:"workers" default:"{maxpool}" min:"1"`
+	Queue      uint   `conf:"queue" default:"{nextpool}"`
+	Qps        uint   `conf:"qps" default:"0"`
+	QpsBurst   uint   `conf:"qpsburst" default:"{qps}"`
+	ZoneConc   uint   `conf:"zoneconc" default:"0"`
+	Sorted     bool   `conf:"sorted" default:"0"`
+	ForceCount uint   `conf:"forcecount" default:"0"`
+	Version    string `conf:"version" default:"1.0" oneof:"1.0|2.0"`
+	Output     string `conf:"output" default:"json" oneof:"json|jsonl"`
+
+	RPZFile   string `conf:"rpzfile" path:"parent"`
+	RPZOrigin string `conf:"rpzorigin" default:"rpz.local"`
+	RPZAction string `conf:"rpzaction" default:"nxdomain" oneof:"nxdomain|nodata|cname"`
+	RPZGarden string `conf:"rpzgarden"`
+	RPZTTL    uint   `conf:"rpzttl" default:"300"`
+	AllowList string `conf:"allowlist" path:"file"`
+
+	IPExportDir     string   `conf:"ipexportdir" path:"dir"`
+	IPExportName    string   `conf:"ipexportname" default:"rvz"`
+	IPExportFormats []string `conf:"ipexportformats" default:"ipset,nft,txt" oneof:"ipset|nft|txt"`
+	IPAggregate     bool     `conf:"ipaggregate" default:"0"`
+	IPMask4         uint     `conf:"ipmask4" default:"0" max:"32"`
+	IPMask6         uint     `conf:"ipmask6" default:"0" max:"128"`
+	IPMaxElem       uint     `conf:"ipmaxelem" default:"1048576" min:"1" reload:"no"`
+	IPAllow         []string `conf:"ipallow"`
+	IPCountries     []string `conf:"ipcountries"`
+
+	Cache        string `conf:"cache" default:"off" oneof:"off|memory|disk" reload:"no"`
+	CacheFile    string `conf:"cachefile" default:"{workdir}/dnscache.json" path:"parent" reload:"no"`
+	CacheMaxTTL  uint   `conf:"cachemaxttl" default:"86400" reload:"no"`
+	ForceRefresh uint   `conf:"forcerefresh" default:"0"`
+	Urgent       bool   `conf:"urgent" default:"1"`
+	FullInterval uint   `conf:"fullinterval" default:"0"`
+
+	KeepCount uint   `conf:"keepcount" default:"0"`
+	KeepDays  uint   `conf:"keepdays" default:"0"`
+	KeepMB    uint   `conf:"keepmb" default:"0"`
+	ThinHours uint   `conf:"thinhours" default:"0"`
+	ThinDays  uint   `conf:"thindays" default:"0"`
+	Store     string `conf:"store" path:"parent"`
+	StoreKeep uint   `conf:"storekeep" default:"0"`
+
+	SinkStat     string `conf:"sinkstat"`
+	SinkSnapshot string `conf:"sinksnapshot"`
+	SinkKey      string `conf:"sinkkey"`
+	SinkRetries  uint   `conf:"sinkretries" default:"3"`
+	SinkBackoff  uint   `conf:"sinkbackoff" default:"5"`
+	SinkTimeout  uint   `conf:"sinktimeout" default:"60" min:"1"`
+	SinkSpool    string `conf:"sinkspool" default:"{workdir}/spool"`
+
+	Alerts       string `conf:"alerts"`
+	AlertWebhook string `conf:"alertwebhook"`
+	AlertKey     string `conf:"alertkey"`
+	AlertCommand string `conf:"alertcommand" path:"file"`
+	AlertTimeout uint   `conf:"alerttimeout" default:"30" min:"1"`
+
+	Profiles []string `conf:"profiles"`
+	StubIPs  []string `conf:"stubips"`
+	StubFile string   `conf:"stubfile" path:"file"`
+	ECS      []string `conf:"ecs"`
+	Profile  map[string]*TProfileConfig
+
+	src map[string]string
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("not a boolean")
+}
+
+func setField(f reflect.Value, s string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Uint:
+		if s == "" {
+			f.SetUint(0)
+			return nil
+		}
+		v, err := strconv.ParseUint(s, 10, 0)
+		if err != nil {
+			return fmt.Errorf("not a number")
+		}
+		f.SetUint(v)
+	case reflect.Bool:
+		v, err := parseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(v)
+	case reflect.Slice:
+		var list []string
+		for _, i := range strings.Split(s, ",") {
+			if i = strings.TrimSpace(i); i != "" {
+				list = append(list, i)
+			}
+		}
+		f.Set(reflect.ValueOf(list))
+	}
+	return nil
+}
+
+// errorf formats an error about a key with where it was set: the line,
+// the flag or the environment variable.
+func (cfg *TConfig) errorf(key, format string, a ...interface{}) string {
+	if src, ok := cfg.src[key]; ok {
+		return fmt.Sprintf("Config %s invalid: %s (%s)", src, key, fmt.Sprintf(format, a...))
+	}
+	return fmt.Sprintf("Config %s invalid: %s", key, fmt.Sprintf(format, a...))
+}
+
+// configEnv is the environment variable of key, the dots of the profile
+// keys become _.
+func configEnv(key string) string {
+	return "RVZ_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// confKeys returns the keys of a config struct.
+func confKeys(t reflect.Type) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("conf"); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ConfigFlags adds a flag for every key and for the profile keys named in
+// args, as the profile names are only known once the config is read. The
+// returned func gives the keys set on the command line once fs is parsed.
+func ConfigFlags(fs *flag.FlagSet, args []string) func() map[string]string {
+	keys := make(map[string]bool)
+	add := func(key string) {
+		if !keys[key] {
+			keys[key] = true
+			fs.String(key, "", fmt.Sprintf("Config %s (or %s)", key, configEnv(key)))
+		}
+	}
+	for _, key := range confKeys(reflect.TypeOf(TConfig{})) {
+		add(key)
+	}
+	pkeys := make(map[string]bool)
+	for _, key := range confKeys(reflect.TypeOf(TProfileConfig{})) {
+		pkeys[key] = true
+	}
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		if !strings.HasPrefix(arg, "-") || !strings.HasPrefix(name, "profile.") {
+			continue
+		}
+		if f := strings.Split(name, "."); len(f) == 3 && profileName.MatchString(f[1]) && pkeys[f[2]] {
+			add(name)
+		}
+	}
+	return func() map[string]string {
+		res := make(map[string]string)
+		fs.Visit(func(f *flag.Flag) {
+			if keys[f.Name] {
+				res[f.Name] = f.Value.String()
+			}
+		})
+		return res
+	}
+}
+
+// LoadConfig reads the typed configuration from the flags, the environment
+// and the file. Values that don't parse and unknown keys of the file are
+// errors.
+func LoadConfig(c *Config, flags map[string]string) (*TConfig, error) {
+	cfg := &TConfig{src: make(map[string]string)}
+	errs := cfg.load(reflect.ValueOf(cfg).Elem(), "", c, flags)
+	cfg.Profile = make(map[string]*TProfileConfig)
+	for _, name := range cfg.Profiles {
+		p := &TProfileConfig{}
+		errs = append(errs, cfg.load(reflect.ValueOf(p).Elem(), profilePrefix(name), c, flags)...)
+		cfg.Profile[name] = p
+	}
+	if src := cfg.src["APIKey"]; cfg.APIKeyFile != "" && !strings.HasPrefix(src, "flag") && !strings.HasPrefix(src, "env") {
+		dat, err := ioutil.ReadFile(cfg.APIKeyFile)
+		if err != nil {
+			errs = append(errs, cfg.errorf("apikeyfile", "%s", err.Error()))
+		} else {
+			cfg.APIKey = strings.TrimSpace(string(dat))
+			cfg.src["APIKey"] = cfg.src["apikeyfile"]
+		}
+	}
+	if s := c.CheckUnread(); s != "" {
+		errs = append(errs, fmt.Sprintf("Config unknown keys: %s", s))
+	}
+	var unknown []string
+	for key := range flags {
+		if !strings.HasPrefix(cfg.src[key], "flag") {
+			unknown = append(unknown, "-"+key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		errs = append(errs, fmt.Sprintf("Config unknown flags: %s", strings.Join(unknown, " ")))
+	}
+	if s := unknownEnv(cfg.Profiles); s != "" {
+		errs = append(errs, fmt.Sprintf("Config unknown environment: %s", s))
+	}
+	if len(errs) > 0 {
+		return cfg, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return cfg, nil
+}
+
+// unknownEnv returns the RVZ_ variables of the environment that are not
+// a key, those of the alert command aside.
+func unknownEnv(profiles []string) string {
+	known := make(map[string]bool)
+	for _, key := range confKeys(reflect.TypeOf(TConfig{})) {
+		known[configEnv(key)] = true
+	}
+	for _, name := range profiles {
+		for _, key := range confKeys(reflect.TypeOf(TProfileConfig{})) {
+			known[configEnv(profilePrefix(name)+key)] = true
+		}
+	}
+	var unknown []string
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(name, "RVZ_") && !strings.HasPrefix(name, CAlertEnv) && !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return strings.Join(unknown, " ")
+}
+
+// load sets the fields of v from the keys prefix+conf, the defaults refer
+// to the keys of the same struct.
+func (cfg *TConfig) load(v reflect.Value, prefix string, c *Config, flags map[string]string) []string {
+	var errs []string
+	vals := make(map[string]string)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("conf")
+		if key == "" {
+			continue
+		}
+		_key := prefix + key
+		s, l, ok := c.Lookup(_key)
+		if ok {
+			cfg.src[_key] = fmt.Sprintf("line %d", l)
+		}
+		if _s, _ok := os.LookupEnv(configEnv(_key)); _ok {
+			s, ok = _s, true
+			cfg.src[_key] = "env " + configEnv(_key)
+		}
+		if _s, _ok := flags[_key]; _ok {
+			s, ok = _s, true
+			cfg.src[_key] = "flag -" + _key
+		}
+		if !ok {
+			s = t.Field(i).Tag.Get("default")
+			for k, _v := range vals {
+				s = strings.Replace(s, "{"+k+"}", _v, -1)
+			}
+		}
+		vals[key] = s
+		if err := setField(v.Field(i), s); err != nil {
+			errs = append(errs, cfg.errorf(_key, "%s: %s", s, err.Error()))
+		}
+	}
+	return errs
+}
+
+func checkPath(kind, filename string) error {
+	if kind == "parent" {
+		kind, filename = "dir", filepath.Dir(filename)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if kind == "dir" && !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", filename)
+	}
+	if kind == "file" && fi.IsDir() {
+		return fmt.Errorf("%s is a directory", filename)
+	}
+	return nil
+}
+
+// validate checks the tags of the fields of v, their keys are prefix+conf.
+func (cfg *TConfig) validate(v reflect.Value, prefix string) []string {
+	var errs []string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag
+		key := tag.Get("conf")
+		if key == "" {
+			continue
+		}
+		key = prefix + key
+		f := v.Field(i)
+		if tag.Get("required") != "" && (f.Kind() == reflect.String || f.Kind() == reflect.Slice) && f.Len() == 0 {
+			errs = append(errs, cfg.errorf(key, "required"))
+			continue
+		}
+		if f.Kind() == reflect.Uint {
+			if min, err := strconv.ParseUint(tag.Get("min"), 10, 0); err == nil && f.Uint() < min {
+				errs = append(errs, cfg.errorf(key, "%d is less than %d", f.Uint(), min))
+			}
+			if max, err := strconv.ParseUint(tag.Get("max"), 10, 0); err == nil && f.Uint() > max {
+				errs = append(errs, cfg.errorf(key, "%d is more than %d", f.Uint(), max))
+			}
+		}
+		if oneof := tag.Get("oneof"); oneof != "" {
+			values := []string{f.String()}
+			if f.Kind() == reflect.Slice {
+				values = f.Interface().([]string)
+			}
+			for _, _v := range values {
+				if !strings.Contains("|"+oneof+"|", "|"+_v+"|") {
+					errs = append(errs, cfg.errorf(key, "%s is not one of %s", _v, strings.Replace(oneof, "|", ", ", -1)))
+				}
+			}
+		}
+		if kind := tag.Get("path"); kind != "" && f.String() != "" {
+			if _, set := cfg.src[key]; set {
+				if err := checkPath(kind, f.String()); err != nil {
+					errs = append(errs, cfg.errorf(key, "%s", err.Error()))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// Validate checks the values the daemon needs, every problem is reported.
+func (cfg *TConfig) Validate() error {
+	errs := cfg.validate(reflect.ValueOf(cfg).Elem(), "")
+	names := make(map[string]bool)
+	for _, name := range cfg.Profiles {
+		if names[name] {
+			errs = append(errs, cfg.errorf("profiles", "%s is repeated", name))
+			continue
+		}
+		names[name] = true
+		if !profileName.MatchString(name) {
+			errs = append(errs, cfg.errorf("profiles", "%s is not a valid profile name", name))
+			continue
+		}
+		if profileReserved[name] {
+			errs = append(errs, cfg.errorf("profiles", "%s is a reserved name", name))
+			continue
+		}
+		errs = append(errs, cfg.validate(reflect.ValueOf(cfg.Profile[name]).Elem(), profilePrefix(name))...)
+		if _, err := ParsePrefixes(cfg.Profile[name].ECS); err != nil {
+			errs = append(errs, cfg.errorf(profilePrefix(name)+"ecs", "%s", err.Error()))
+		} else if _, err := NewProfile(name, cfg.Profile[name], cfg.DnsPort); err != nil {
+			errs = append(errs, cfg.errorf(profilePrefix(name)+"servers", "%s", err.Error()))
+		}
+	}
+	if len(cfg.Profiles) > 0 {
+		// The profiles have their own servers and subnets.
+		for _, k := range [][2]string{{"dnshost", "servers"}, {"ecs", "ecs"}} {
+			if _, ok := cfg.src[k[0]]; ok {
+				errs = append(errs, cfg.errorf(k[0], "not used with profiles, set profile.<name>.%s", k[1]))
+			}
+		}
+	} else if _, err := nameserver(cfg.DnsHost, fmt.Sprintf("%d", cfg.DnsPort)); err != nil {
+		errs = append(errs, cfg.errorf("dnshost", "%s", err.Error()))
+	}
+	if cfg.APIKey == "****" {
+		errs = append(errs, cfg.errorf("APIKey", "placeholder key"))
+	}
+	if cfg.Queue >= cfg.Workers {
+		key := "queue"
+		if _, ok := cfg.src[key]; !ok {
+			key = "nextpool"
+		}
+		errs = append(errs, cfg.errorf(key, "queue %d must be less than workers %d", cfg.Queue, cfg.Workers))
+	}
+	if _, err := ParsePrefixes(cfg.IPAllow); err != nil {
+		errs = append(errs, cfg.errorf("ipallow", "%s", err.Error()))
+	}
+	if _, err := ParsePrefixes(cfg.ECS); err != nil {
+		errs = append(errs, cfg.errorf("ecs", "%s", err.Error()))
+	}
+	if _, err := ParsePrefixes(cfg.StubIPs); err != nil {
+		errs = append(errs, cfg.errorf("stubips", "%s", err.Error()))
+	}
+	if cfg.RPZAction == CRPZActionCname && cfg.RPZGarden == "" {
+		errs = append(errs, cfg.errorf("rpzgarden", "required by rpzaction=%s", cfg.RPZAction))
+	}
+	if _, err := ParseAlertRules(cfg.Alerts); err != nil {
+		errs = append(errs, cfg.errorf("alerts", "%s", err.Error()))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
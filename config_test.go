@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testLoad loads the config file made of lines with the flags.
+func testLoad(t *testing.T, flags map[string]string, lines ...string) (*TConfig, error) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "revizorro.conf")
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfigFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(c, flags)
+}
+
+// testConfig loads and validates the config file made of lines.
+func testConfig(t *testing.T, lines ...string) (*TConfig, error) {
+	t.Helper()
+	conf, err := testLoad(t, nil, lines...)
+	if err != nil {
+		return conf, err
+	}
+	return conf, conf.Validate()
+}
+
+func TestConfigRPZGarden(t *testing.T) {
+	_, err := testConfig(t, "APIKey=key", "rpzaction=cname")
+	if err == nil || !strings.Contains(err.Error(), "rpzgarden") {
+		t.Fatalf("cname without rpzgarden: %v", err)
+	}
+	if _, err := testConfig(t, "APIKey=key", "rpzaction=cname", "rpzgarden=garden.local"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testConfig(t, "APIKey=key", "rpzaction=nodata"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigProfiles(t *testing.T) {
+	base := []string{"APIKey=key", "profiles=a,b", "profile.a.servers=127.0.0.1", "profile.b.servers=192.0.2.53:5353"}
+	conf, err := testConfig(t, base...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Profile) != 2 || conf.Profile["b"].Servers[0] != "192.0.2.53:5353" {
+		t.Errorf("profiles %v", conf.Profile)
+	}
+	for _, extra := range []string{"dnshost=192.0.2.1", "ecs=203.0.113.0/24"} {
+		key := strings.SplitN(extra, "=", 2)[0]
+		if _, err := testConfig(t, append(base, extra)...); err == nil || !strings.Contains(err.Error(), "line 5 invalid: "+key) {
+			t.Errorf("%s with profiles: %v", key, err)
+		}
+	}
+	for _, name := range []string{"result", "urgent", "dnscache", "ipindex", "drift", "compare", "current", "dump", "domains", "laststat"} {
+		_, err := testConfig(t, "APIKey=key", "profiles="+name, "profile."+name+".servers=127.0.0.1")
+		if err == nil || !strings.Contains(err.Error(), "line 2 invalid: profiles ("+name+" is a reserved name)") {
+			t.Errorf("profile %s: %v", name, err)
+		}
+	}
+	if _, err := testConfig(t, append(base, "profile.a.ecs=203.0.113.0/24")...); err != nil {
+		t.Error(err)
+	}
+	if _, err := testConfig(t, "APIKey=key", "dnshost=192.0.2.1", "ecs=203.0.113.0/24"); err != nil {
+		t.Error(err)
+	}
+	for _, host := range []string{"resolver.example", "[2001:db8::1]:53"} {
+		if _, err := testConfig(t, "APIKey=key", "dnshost="+host); err != nil {
+			t.Errorf("dnshost %s: %v", host, err)
+		}
+	}
+	for _, host := range []string{"bad host", ":53", "192.0.2.1:"} {
+		if _, err := testConfig(t, "APIKey=key", "dnshost="+host); err == nil || !strings.Contains(err.Error(), "line 2 invalid: dnshost") {
+			t.Errorf("dnshost %s: %v", host, err)
+		}
+	}
+}
+
+func TestConfigProfileFlags(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "revizorro.conf")
+	if err := os.WriteFile(filename, []byte("APIKey=key\nprofiles=a,b_c\nprofile.a.servers=127.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RVZ_PROFILE_B_C_SERVERS", "192.0.2.53")
+	fs := flag.NewFlagSet("rvz", flag.ContinueOnError)
+	args := []string{"-workers", "500", "-profile.a.servers=192.0.2.1", "--profile.a.udpsize", "1232"}
+	conflags := ConfigFlags(fs, args)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfigFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadConfig(c, conflags())
+	if err == nil {
+		err = conf.Validate()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := conf.Profile["a"]; a.Servers[0] != "192.0.2.1" || a.UDPSize != 1232 || conf.Workers != 500 {
+		t.Errorf("profile a %+v, workers %d", a, conf.Workers)
+	}
+	if bc := conf.Profile["b_c"]; bc.Servers[0] != "192.0.2.53" || conf.src["profile.b_c.servers"] != "env RVZ_PROFILE_B_C_SERVERS" {
+		t.Errorf("profile b_c %+v from %s", bc, conf.src["profile.b_c.servers"])
+	}
+
+	// A flag of a profile that isn't in profiles is an error.
+	fs = flag.NewFlagSet("rvz", flag.ContinueOnError)
+	args = []string{"-profile.x.servers", "192.0.2.1"}
+	conflags = ConfigFlags(fs, args)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = ReadConfigFile(filename)
+	if _, err := LoadConfig(c, conflags()); err == nil || !strings.Contains(err.Error(), "-profile.x.servers") {
+		t.Errorf("unknown profile flag: %v", err)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		env   string
+		flags map[string]string
+		want  string
+		src   string
+	}{
+		{"file", "", nil, "192.0.2.1", "line 2"},
+		{"env", "192.0.2.2", nil, "192.0.2.2", "env RVZ_DNSHOST"},
+		{"flag", "192.0.2.2", map[string]string{"dnshost": "192.0.2.3"}, "192.0.2.3", "flag -dnshost"},
+		{"flag without env", "", map[string]string{"dnshost": "192.0.2.3"}, "192.0.2.3", "flag -dnshost"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if c.env != "" {
+				t.Setenv("RVZ_DNSHOST", c.env)
+			}
+			conf, err := testLoad(t, c.flags, "APIKey=key", "dnshost=192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.DnsHost != c.want || conf.src["dnshost"] != c.src {
+				t.Errorf("dnshost %s from %s, want %s from %s", conf.DnsHost, conf.src["dnshost"], c.want, c.src)
+			}
+		})
+	}
+	// A default refers to the value of the key whatever its source.
+	t.Setenv("RVZ_WORKDIR", "/srv/rvz")
+	conf, err := testLoad(t, nil, "APIKey=key")
+	if err != nil || conf.CacheFile != "/srv/rvz/dnscache.json" {
+		t.Errorf("cachefile %s %v", conf.CacheFile, err)
+	}
+}
+
+func TestConfigAPIKeyFile(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "apikey")
+	if err := os.WriteFile(keyfile, []byte("filekey\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	for _, c := range []struct {
+		name    string
+		env     string
+		flags   map[string]string
+		keyfile string
+		want    string
+	}{
+		{"file", "", nil, keyfile, "filekey"},
+		{"env", "envkey", nil, missing, "envkey"},
+		{"flag", "", map[string]string{"APIKey": "flagkey"}, missing, "flagkey"},
+		{"flag over env", "envkey", map[string]string{"APIKey": "flagkey"}, missing, "flagkey"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if c.env != "" {
+				t.Setenv("RVZ_APIKEY", c.env)
+			}
+			conf, err := testLoad(t, c.flags, "APIKey=confkey", "apikeyfile="+c.keyfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.APIKey != c.want {
+				t.Errorf("APIKey %s, want %s", conf.APIKey, c.want)
+			}
+		})
+	}
+	if _, err := testLoad(t, nil, "APIKey=confkey", "apikeyfile="+missing); err == nil || !strings.Contains(err.Error(), "apikeyfile") {
+		t.Errorf("missing apikeyfile: %v", err)
+	}
+}
+
+func TestConfigUnknownEnv(t *testing.T) {
+	for _, c := range []struct {
+		name, env, unknown string
+	}{
+		{"typo", "RVZ_WORKRES", "RVZ_WORKRES"},
+		{"alert command", "RVZ_ALERT_RULES", ""},
+		{"profile", "RVZ_PROFILE_A_UDPSIZE", ""},
+		{"profile not in profiles", "RVZ_PROFILE_X_SERVERS", "RVZ_PROFILE_X_SERVERS"},
+		{"profile typo", "RVZ_PROFILE_A_SERVER", "RVZ_PROFILE_A_SERVER"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv(c.env, "1232")
+			_, err := testLoad(t, nil, "APIKey=key", "profiles=a", "profile.a.servers=127.0.0.1")
+			if c.unknown == "" && err != nil {
+				t.Error(err)
+			}
+			if c.unknown != "" && (err == nil || !strings.Contains(err.Error(), "unknown environment: "+c.unknown)) {
+				t.Errorf("%s: %v", c.env, err)
+			}
+		})
+	}
+}
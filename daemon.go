@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// TDaemon is what the main loop runs with, it is built again from the
+// config on reload.
+type TDaemon struct {
+	Conf         *TConfig
+	Resolve      *TResolveConfig
+	RPZ          *TRPZ
+	Allow        *TAllowList
+	Retention    *TRetention
+	Urgent       bool
+	ForceRefresh time.Duration
+	FullInterval time.Duration
+}
+
+// NewDaemon builds the daemon from a validated config, the cache is kept
+// across reloads when given.
+func NewDaemon(conf *TConfig, cache *TCache) (*TDaemon, error) {
+	d := &TDaemon{
+		Conf:         conf,
+		Urgent:       conf.Urgent,
+		ForceRefresh: time.Duration(conf.ForceRefresh) * time.Second,
+		FullInterval: time.Duration(conf.FullInterval) * time.Second,
+	}
+	_workdir := conf.Workdir
+	_geo := TGeoConfig{
+		CountryFile: conf.MmdbFile,
+		CityFile:    conf.CityMmdbFile,
+		AsnFile:     conf.AsnMmdbFile,
+		Home:        conf.HomeCountry,
+		TopN:        conf.TopN,
+	}
+
+	if conf.RPZFile != "" {
+		d.RPZ = &TRPZ{
+			Filename: conf.RPZFile,
+			Origin:   conf.RPZOrigin,
+			Action:   conf.RPZAction,
+			Garden:   conf.RPZGarden,
+			TTL:      conf.RPZTTL,
+		}
+	}
+
+	if conf.AllowList != "" {
+		var err error
+		if d.Allow, err = ReadAllowList(conf.AllowList); err != nil {
+			return nil, err
+		}
+	}
+
+	var _ipexport *TIPExport
+	if conf.IPExportDir != "" {
+		_ipallow, _ := ParsePrefixes(conf.IPAllow)
+		_ipexport = &TIPExport{
+			Dir:       conf.IPExportDir,
+			Name:      conf.IPExportName,
+			Formats:   conf.IPExportFormats,
+			Aggregate: conf.IPAggregate,
+			Mask4:     int(conf.IPMask4),
+			Mask6:     int(conf.IPMask6),
+			MaxElem:   int(conf.IPMaxElem),
+			Allow:     _ipallow,
+			Countries: conf.IPCountries,
+		}
+	}
+
+	if cache == nil && conf.Cache != CCacheOff {
+		_cachefile := ""
+		if conf.Cache == CCacheDisk {
+			_cachefile = conf.CacheFile
+		}
+		var err error
+		cache, err = NewCache(_cachefile, uint32(conf.CacheMaxTTL))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Can't load DNS cache: %s\n", err.Error())
+		}
+	}
+
+	_sink := &TSink{
+		StatURL:     conf.SinkStat,
+		SnapshotURL: conf.SinkSnapshot,
+		Key:         conf.SinkKey,
+		Retries:     conf.SinkRetries,
+		Backoff:     time.Duration(conf.SinkBackoff) * time.Second,
+		Timeout:     time.Duration(conf.SinkTimeout) * time.Second,
+		Spool:       conf.SinkSpool,
+	}
+
+	_alertrules, _ := ParseAlertRules(conf.Alerts)
+	_alerts := &TAlerts{
+		Rules:   _alertrules,
+		Webhook: conf.AlertWebhook,
+		Key:     conf.AlertKey,
+		Command: conf.AlertCommand,
+		Timeout: time.Duration(conf.AlertTimeout) * time.Second,
+		Dir:     _workdir,
+	}
+
+	d.Retention = &TRetention{
+		Count:     conf.KeepCount,
+		Days:      conf.KeepDays,
+		SizeMB:    conf.KeepMB,
+		ThinHours: conf.ThinHours,
+		ThinDays:  conf.ThinDays,
+	}
+
+	var _profiles []*TProfile
+	for _, name := range conf.Profiles {
+		p, err := NewProfile(name, conf.Profile[name], conf.DnsPort)
+		if err != nil {
+			return nil, err
+		}
+		_profiles = append(_profiles, p)
+	}
+
+	var _stubs *TStubs
+	if conf.StubFile != "" || len(conf.StubIPs) > 0 {
+		var err error
+		if _stubs, err = ReadStubs(conf.StubFile, conf.StubIPs); err != nil {
+			return nil, err
+		}
+	}
+
+	_ecs, _ := ParsePrefixes(conf.ECS)
+
+	var _store *TStore
+	if conf.Store != "" {
+		_store = NewStore(conf.Store)
+	}
+
+	d.Resolve = &TResolveConfig{
+		DnsHost:     conf.DnsHost,
+		DnsPort:     fmt.Sprintf("%d", conf.DnsPort),
+		DomainsFile: fmt.Sprintf("%s/domains.lst", _workdir),
+		RegIPsFile:  fmt.Sprintf("%s/domains.ip", _workdir),
+		Workdir:     _workdir,
+		Results:     conf.Results,
+		Version:     conf.Version,
+		Output:      conf.Output,
+		Geo:         _geo,
+		Workers:     conf.Workers,
+		Queue:       conf.Queue,
+		Qps:         conf.Qps,
+		QpsBurst:    conf.QpsBurst,
+		ZoneConc:    conf.ZoneConc,
+		Sorted:      conf.Sorted,
+		ForceCount:  conf.ForceCount,
+		Allow:       d.Allow,
+		IPExport:    _ipexport,
+		Sink:        _sink,
+		Alerts:      _alerts,
+		Cache:       cache,
+		Store:       _store,
+		StoreKeep:   conf.StoreKeep,
+		Profiles:    _profiles,
+		Stubs:       _stubs,
+		ECS:         _ecs,
+	}
+	return d, nil
+}
+
+type tchange struct {
+	key    string
+	old    string
+	reload bool
+}
+
+// changes returns the keys of conf that differ from the running config, in
+// the order of TConfig, with the values they run with.
+func (d *TDaemon) changes(conf *TConfig) []tchange {
+	var res []tchange
+	o := reflect.ValueOf(d.Conf).Elem()
+	n := reflect.ValueOf(conf).Elem()
+	t := n.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("conf")
+		if key != "" && !reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			res = append(res, tchange{key, fmt.Sprint(o.Field(i).Interface()), t.Field(i).Tag.Get("reload") != "no"})
+		}
+	}
+	for _, name := range conf.Profiles {
+		if !reflect.DeepEqual(d.Conf.Profile[name], conf.Profile[name]) {
+			res = append(res, tchange{key: "profile." + name, reload: true})
+		}
+	}
+	return res
+}
+
+// resolverID tells what the answers of the first profile depend on, the
+// ones in the cache.
+func resolverID(cfg *TResolveConfig) string {
+	if len(cfg.Profiles) == 0 {
+		return fmt.Sprint(cfg.DnsHost, cfg.DnsPort, cfg.ECS)
+	}
+	p := cfg.Profiles[0]
+	return fmt.Sprint(p.Servers, p.EDNS, p.DO, p.ECS)
+}
+
+// ReloadConfig reads and validates the config file again with the same
+// flags, on error the running daemon is kept. A missing file is an error
+// when it was given explicitly. The keys tagged reload:"no" are given
+// their running values, so the defaults built from them don't move, and
+// each of them is logged. The DNS cache is dropped when the first profile
+// asks other servers or sends other options.
+func ReloadConfig(d *TDaemon, conffile string, explicit bool, flags map[string]string) *TDaemon {
+	fmt.Printf("Reload config %s\n", conffile)
+	_cfg, err := ReadConfigFile(conffile)
+	if err != nil && (explicit || !os.IsNotExist(err)) {
+		fmt.Fprintf(os.Stderr, "Error: Config not reloaded: %s\n", err.Error())
+		return d
+	}
+	conf, err := LoadConfig(_cfg, flags)
+	var rejected, unset []string
+	if err == nil {
+		_flags := make(map[string]string)
+		for k, v := range flags {
+			_flags[k] = v
+		}
+		for _, c := range d.changes(conf) {
+			if c.reload {
+				continue
+			}
+			// The keys set neither now nor before are defaults built
+			// from the others, they follow them.
+			if _, ok := conf.src[c.key]; ok {
+				rejected = append(rejected, c.key)
+			} else if _, ok := d.Conf.src[c.key]; ok {
+				unset = append(unset, c.key+"="+c.old)
+			}
+			_flags[c.key] = c.old
+		}
+		if len(_flags) > len(flags) {
+			conf, err = LoadConfig(_cfg, _flags)
+		}
+	}
+	if err == nil {
+		err = conf.Validate()
+	}
+	if err != nil {
+		for _, _e := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "Error: Config not reloaded: %s\n", _e)
+		}
+		return d
+	}
+	_d, err := NewDaemon(conf, d.Resolve.Cache)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Config not reloaded: %s\n", err.Error())
+		return d
+	}
+	for _, k := range rejected {
+		fmt.Fprintf(os.Stderr, "Error: Config key %s rejected, can't be changed without a restart\n", k)
+	}
+	for _, kv := range unset {
+		fmt.Fprintf(os.Stderr, "Error: Config key %s kept, can't be unset without a restart\n", kv)
+	}
+	var applied []string
+	for _, c := range d.changes(conf) {
+		applied = append(applied, c.key)
+	}
+	if len(applied) > 0 {
+		fmt.Printf("Config applied: %s\n", strings.Join(applied, ", "))
+	}
+	if _d.Resolve.Cache != nil && resolverID(_d.Resolve) != resolverID(d.Resolve) {
+		_d.Resolve.Cache.Clear()
+		fmt.Printf("DNS cache dropped, the servers changed\n")
+	}
+	_d.Resolve.Store.requeue(d.Resolve.Store)
+	d.Resolve.Sink.Stop()
+	return _d
+}
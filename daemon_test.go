@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// captureOutput returns what f prints to stdout and stderr.
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	done := make(chan []byte)
+	go func() {
+		dat, _ := ioutil.ReadAll(r)
+		done <- dat
+	}()
+	f()
+	os.Stdout, os.Stderr = stdout, stderr
+	w.Close()
+	return string(<-done)
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	base := []string{"APIKey=key", "workdir=" + dir, "topn=10", "dnshost=192.0.2.53", "cache=memory"}
+	for _, c := range []struct {
+		name    string
+		lines   []string
+		reload  bool
+		workdir string
+		topn    uint
+		errors  int
+		log     []string
+	}{
+		{"unchanged", base, true, dir, 10, 0, nil},
+		{"changed", []string{base[0], base[1], "topn=20", base[3], base[4]}, true, dir, 20, 0,
+			[]string{"Config applied: topn"}},
+		{"rejected", []string{base[0], "workdir=" + other, "topn=20", base[3], base[4]}, true, dir, 20, 1,
+			[]string{"Config key workdir rejected", "Config applied: topn"}},
+		{"removed", []string{base[0], base[2], base[3], base[4]}, true, dir, 10, 1,
+			[]string{"Config key workdir=" + dir + " kept"}},
+		{"servers", []string{base[0], base[1], base[2], "dnshost=192.0.2.54", base[4]}, true, dir, 10, 0,
+			[]string{"DNS cache dropped", "Config applied: dnshost"}},
+		{"invalid", []string{base[0], base[1], "topn=many", base[3], base[4]}, false, dir, 10, 1,
+			[]string{"Config not reloaded"}},
+	} {
+		conf, err := testConfig(t, base...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := NewDaemon(conf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Resolve.Cache.Put("a.example", dns.TypeA, testAnswer(t, "a.example", "a.example. 300 IN A 192.0.2.1"))
+		conffile := filepath.Join(t.TempDir(), "revizorro.conf")
+		if err := ioutil.WriteFile(conffile, []byte(strings.Join(c.lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var _d *TDaemon
+		out := captureOutput(t, func() {
+			_d = ReloadConfig(d, conffile, true, nil)
+		})
+		if (_d != d) != c.reload {
+			t.Errorf("%s: reloaded %v, want %v", c.name, _d != d, c.reload)
+		}
+		if _d.Conf.Workdir != c.workdir || _d.Conf.TopN != c.topn {
+			t.Errorf("%s: workdir %s topn %d, want %s %d", c.name, _d.Conf.Workdir, _d.Conf.TopN, c.workdir, c.topn)
+		}
+		applied := false
+		for _, l := range c.log {
+			if !strings.Contains(out, l) {
+				t.Errorf("%s: no %q in %q", c.name, l, out)
+			}
+			applied = applied || strings.HasPrefix(l, "Config applied")
+		}
+		if n := strings.Count(out, "Error:"); n != c.errors || strings.Contains(out, "Config applied") != applied {
+			t.Errorf("%s: %d errors in %q", c.name, n, out)
+		}
+		_, hit := _d.Resolve.Cache.Get("a.example", dns.TypeA)
+		if hit != (c.name != "servers") {
+			t.Errorf("%s: cache hit %v", c.name, hit)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// WriteDomainsDelta compares the new domain set with the previous domain
+// list and writes the added (urgent ones first) and removed domains. Without
+// a previous list both files are left empty, the full sweep covers
+// everything anyway.
+func WriteDomainsDelta(prev, added, removed string, domains, urgent map[string]bool) (int, int, error) {
+	var _added, _removed []string
+	if _, err := os.Stat(prev); err == nil {
+		old, _, err := domainListRead(prev)
+		if err != nil {
+			return 0, 0, err
+		}
+		_old := make(map[string]bool, len(old))
+		for _, d := range old {
+			_old[d] = true
+			if !domains[d] {
+				_removed = append(_removed, d)
+			}
+		}
+		for d := range domains {
+			if !_old[d] {
+				_added = append(_added, d)
+			}
+		}
+	}
+	sort.Slice(_added, func(i, j int) bool {
+		if urgent[_added[i]] != urgent[_added[j]] {
+			return urgent[_added[i]]
+		}
+		return _added[i] < _added[j]
+	})
+	sort.Strings(_removed)
+	for _, f := range []struct {
+		name string
+		list []string
+	}{{added, _added}, {removed, _removed}} {
+		err := writeLines(f.name, func(w *bufio.Writer) {
+			for _, d := range f.list {
+				fmt.Fprintf(w, "%s\n", d)
+			}
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(_added), len(_removed), nil
+}
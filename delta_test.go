@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// parseDump parses a dump of the domains into dir, urgent ones are marked
+// with a leading !, and returns the domain list, the added and the removed
+// domains.
+func parseDump(t *testing.T, dir string, domains ...string) (list, added, removed []string) {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<register updateTime=\"2023-11-14T22:13:20+00:00\">\n")
+	for i, d := range domains {
+		urgent := strings.HasPrefix(d, "!")
+		fmt.Fprintf(&b, "<content id=\"%d\" urgencyType=\"%v\"><domain>%s</domain></content>\n", i, urgent, strings.TrimPrefix(d, "!"))
+	}
+	b.WriteString("</register>\n")
+	src := filepath.Join(dir, CXMLDumpName)
+	if err := ioutil.WriteFile(src, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "domains.txt")
+	err := ParseDomains(src, dest, filepath.Join(dir, "regips.txt"), filepath.Join(dir, "added.txt"), filepath.Join(dir, "removed.txt"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) []string {
+		l, _, err := domainListRead(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	list = read("domains.txt")
+	sort.Strings(list)
+	return list, read("added.txt"), read("removed.txt")
+}
+
+func TestDomainsDelta(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		name                 string
+		dump                 []string
+		list, added, removed []string
+	}{
+		// The first dump has nothing to compare with.
+		{"first", []string{"a.example", "b.example"}, []string{"a.example", "b.example"}, nil, nil},
+		{"unchanged", []string{"b.example", "a.example"}, []string{"a.example", "b.example"}, nil, nil},
+		{"add and remove", []string{"b.example", "c.example", "!e.example", "d.example"}, []string{"b.example", "c.example", "d.example", "e.example"},
+			[]string{"e.example", "c.example", "d.example"}, []string{"a.example"}},
+		{"remove all", nil, nil, nil, []string{"b.example", "c.example", "d.example", "e.example"}},
+	} {
+		list, added, removed := parseDump(t, dir, c.dump...)
+		if !reflect.DeepEqual(list, c.list) || !reflect.DeepEqual(added, c.added) || !reflect.DeepEqual(removed, c.removed) {
+			t.Errorf("%s: list %v added %v removed %v, want %v %v %v", c.name, list, added, removed, c.list, c.added, c.removed)
+		}
+	}
+}
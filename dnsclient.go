@@ -4,18 +4,22 @@ import (
 	"fmt"
 	"github.com/miekg/dns"
 	"math/rand"
+	"net/netip"
 	"time"
 )
 
 const ATTEMPTS = 1
 const TIMEOUT = 30
 
-func GetRR(domain string, nameservers []string, qtype uint16) (r *dns.Msg, rtt time.Duration, err error) {
+// GetRR asks the servers of the profile, with the EDNS client subnet when
+// it is valid.
+func GetRR(domain string, p *TProfile, qtype uint16, subnet netip.Prefix, limiter *TLimiter) (r *dns.Msg, rtt time.Duration, err error) {
+	nameservers := p.Servers
 	if len(nameservers) == 0 {
 		err = fmt.Errorf("%s", "No nameservers!")
 		return
 	}
-	for a := 0; a < ATTEMPTS; a++ {
+	for a := 0; a < p.Attempts; a++ {
 		if a > 1 {
 			time.Sleep(250 * time.Millisecond)
 		}
@@ -33,20 +37,28 @@ func GetRR(domain string, nameservers []string, qtype uint16) (r *dns.Msg, rtt t
 				},
 				Question: make([]dns.Question, 1),
 			}
-			o := &dns.OPT{
-				Hdr: dns.RR_Header{
-					Name:   ".",
-					Rrtype: dns.TypeOPT,
-				},
+			if p.EDNS || subnet.IsValid() {
+				o := &dns.OPT{
+					Hdr: dns.RR_Header{
+						Name:   ".",
+						Rrtype: dns.TypeOPT,
+					},
+				}
+				if p.DO {
+					o.SetDo()
+				}
+				o.SetUDPSize(p.UDPSize)
+				if subnet.IsValid() {
+					o.Option = append(o.Option, ecsOption(subnet))
+				}
+				m.Extra = append(m.Extra, o)
 			}
-			o.SetDo()
-			o.SetUDPSize(dns.DefaultMsgSize)
-			m.Extra = append(m.Extra, o)
 			qt := qtype
 			qc := uint16(dns.ClassINET)
 			m.Question[0] = dns.Question{Name: dns.Fqdn(domain), Qtype: qt, Qclass: qc}
 			m.Id = dns.Id()
-			r, rtt, err = lookup(m, nameserver, true)
+			limiter.Wait()
+			r, rtt, err = lookup(m, nameserver, p.Timeout, true)
 			if err == nil {
 				break
 			}
@@ -58,9 +70,9 @@ func GetRR(domain string, nameservers []string, qtype uint16) (r *dns.Msg, rtt t
 	return r, rtt, err
 }
 
-func lookup(m *dns.Msg, nameserver string, fallback bool) (r *dns.Msg, rtt time.Duration, err error) {
+func lookup(m *dns.Msg, nameserver string, timeout time.Duration, fallback bool) (r *dns.Msg, rtt time.Duration, err error) {
 	c := new(dns.Client)
-	c.Timeout = time.Second * TIMEOUT
+	c.Timeout = timeout
 	if fallback {
 		c.Net = "udp"
 	} else {
@@ -86,7 +98,7 @@ func lookup(m *dns.Msg, nameserver string, fallback bool) (r *dns.Msg, rtt time.
 			if fallback {
 				// First EDNS, then TCP
 				c.Net = "tcp"
-				r, rtt, err = lookup(m, nameserver, false)
+				r, rtt, err = lookup(m, nameserver, timeout, false)
 			}
 		}
 	}
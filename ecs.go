@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"os"
+)
+
+// TSubnetInfo is the answer to a query type with an EDNS client subnet.
+// Scope is the scope prefix length the server returned, missing when the
+// answer has no client subnet option.
+type TSubnetInfo struct {
+	Subnet string   `json:"net"`
+	Qtype  string   `json:"qt"`
+	Scope  *uint8   `json:"scope,omitempty"`
+	Rcode  string   `json:"rc,omitempty"`
+	Error  bool     `json:"err,omitempty"`
+	Ip4    []string `json:"ip4,omitempty"`
+	Ip6    []string `json:"ip6,omitempty"`
+}
+
+func ecsOption(subnet netip.Prefix) *dns.EDNS0_SUBNET {
+	e := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(subnet.Bits()),
+		Address:       net.IP(subnet.Masked().Addr().AsSlice()),
+	}
+	if subnet.Addr().Is6() {
+		e.Family = 2
+	}
+	return e
+}
+
+// ecsScope returns the scope of the client subnet option of the answer.
+func ecsScope(r *dns.Msg) *uint8 {
+	o := r.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if e, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			scope := e.SourceScope
+			return &scope
+		}
+	}
+	return nil
+}
+
+// resolveSubnets asks every query type of the profile once per client
+// subnet, these answers are not cached.
+func resolveSubnets(_domain string, p *TProfile, limiter *TLimiter) []TSubnetInfo {
+	var res []TSubnetInfo
+	for _, subnet := range p.ECS {
+		for _, qtype := range p.Qtypes {
+			info := TSubnetInfo{Subnet: subnet.String(), Qtype: dns.TypeToString[qtype]}
+			release := limiter.AcquireZone(_domain)
+			r, _, err := GetRR(_domain, p, qtype, subnet, limiter)
+			release()
+			if err != nil {
+				info.Error = true
+				fmt.Fprintf(os.Stderr, "Type %s, subnet %s. Internal error (%s): %s\n", info.Qtype, info.Subnet, _domain, err.Error())
+				res = append(res, info)
+				continue
+			}
+			info.Scope = ecsScope(r)
+			if r.Rcode != dns.RcodeSuccess {
+				info.Rcode = dns.RcodeToString[r.Rcode]
+			}
+			for _, rr := range r.Answer {
+				switch _rr := rr.(type) {
+				case *dns.A:
+					info.Ip4 = append(info.Ip4, _rr.A.String())
+				case *dns.AAAA:
+					info.Ip6 = append(info.Ip6, _rr.AAAA.String())
+				}
+			}
+			res = append(res, info)
+		}
+	}
+	return res
+}
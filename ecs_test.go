@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveSubnets(t *testing.T) {
+	port, stop := startDNS(t)
+	defer stop()
+	ecs, err := ParsePrefixes([]string{"203.0.113.7/24", "2001:db8::/56"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := DefaultProfile("127.0.0.1", port, ecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := func(n uint8) *uint8 {
+		return &n
+	}
+	for _, c := range []struct {
+		domain string
+		want   []TSubnetInfo
+		json   string
+	}{
+		{"a.test", []TSubnetInfo{
+			{Subnet: "203.0.113.0/24", Qtype: "A", Scope: scope(16), Ip4: []string{"198.51.100.24"}},
+			{Subnet: "203.0.113.0/24", Qtype: "AAAA", Scope: scope(16)},
+			{Subnet: "2001:db8::/56", Qtype: "A", Scope: scope(48), Ip4: []string{"198.51.100.56"}},
+			{Subnet: "2001:db8::/56", Qtype: "AAAA", Scope: scope(48)},
+		}, `"ecs":[{"net":"203.0.113.0/24","qt":"A","scope":16,"ip4":["198.51.100.24"]},`},
+		// Without the option in the answer there is no scope.
+		{"noecs.test", []TSubnetInfo{
+			{Subnet: "203.0.113.0/24", Qtype: "A", Ip4: []string{"198.51.100.24"}},
+			{Subnet: "203.0.113.0/24", Qtype: "AAAA"},
+			{Subnet: "2001:db8::/56", Qtype: "A", Ip4: []string{"198.51.100.56"}},
+			{Subnet: "2001:db8::/56", Qtype: "AAAA"},
+		}, `"ecs":[{"net":"203.0.113.0/24","qt":"A","ip4":["198.51.100.24"]},`},
+		{"nx.test", []TSubnetInfo{
+			{Subnet: "203.0.113.0/24", Qtype: "A", Scope: scope(16), Rcode: "NXDOMAIN"},
+			{Subnet: "203.0.113.0/24", Qtype: "AAAA", Scope: scope(16), Rcode: "NXDOMAIN"},
+			{Subnet: "2001:db8::/56", Qtype: "A", Scope: scope(48), Rcode: "NXDOMAIN"},
+			{Subnet: "2001:db8::/56", Qtype: "AAAA", Scope: scope(48), Rcode: "NXDOMAIN"},
+		}, `"ecs":[{"net":"203.0.113.0/24","qt":"A","scope":16,"rc":"NXDOMAIN"},`},
+	} {
+		dinfo := resolveDomain(c.domain, p, nil, &TResolveConfig{}, nil, nil)
+		if !reflect.DeepEqual(dinfo.Subnets, c.want) {
+			t.Errorf("%s: subnets %+v\nwant %+v", c.domain, dinfo.Subnets, c.want)
+		}
+		// The answers without a subnet are not those of the subnets.
+		if c.domain == "a.test" && !reflect.DeepEqual(dinfo.Ip4, []string{"192.0.2.7"}) {
+			t.Errorf("%s: ip4 %v", c.domain, dinfo.Ip4)
+		}
+		dat, err := json.Marshal(dinfo)
+		if err != nil || !strings.Contains(string(dat), c.json) {
+			t.Errorf("%s: %s %v, want %s", c.domain, dat, err, c.json)
+		}
+	}
+
+	// Without subnets there is no ecs field.
+	p.ECS = nil
+	dinfo := resolveDomain("a.test", p, nil, &TResolveConfig{}, nil, nil)
+	if dat, _ := json.Marshal(dinfo); dinfo.Subnets != nil || strings.Contains(string(dat), `"ecs"`) {
+		t.Errorf("without subnets: %s", dat)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	CExportCsv     string = "csv"
+	CExportParquet string = "parquet"
+)
+
+// One row per domain and one per domain and address, the lists are
+// joined with commas, the CNAME chain with ">". p and vd are the profile
+// and the verdict of the entry.
+var (
+	exportDomainColumns = []TColumn{
+		{"t", CColInt}, {"domain", CColString}, {"rcode", CColString}, {"error", CColBool},
+		{"empty", CColBool}, {"ip6only", CColBool}, {"dnssec", CColBool}, {"rrsig", CColBool},
+		{"allowed", CColBool}, {"drift", CColBool}, {"cname", CColString}, {"target", CColString},
+		{"ip4_count", CColInt}, {"ip6_count", CColInt}, {"ip4", CColString}, {"ip6", CColString},
+		{"country", CColString}, {"p", CColString}, {"vd", CColString},
+	}
+	exportIPColumns = []TColumn{
+		{"t", CColInt}, {"domain", CColString}, {"target", CColString}, {"ip", CColString},
+		{"family", CColInt}, {"ttl", CColInt}, {"country", CColString}, {"reg_country", CColString},
+		{"city", CColString}, {"asn", CColInt}, {"org", CColString}, {"register", CColBool},
+		{"allowed", CColBool}, {"p", CColString}, {"vd", CColString},
+	}
+)
+
+type TTableWriter interface {
+	Write(row []interface{}) error
+	Close() error
+}
+
+type TCsvWriter struct {
+	w *csv.Writer
+}
+
+func NewCsvWriter(w io.Writer, cols []TColumn) (*TCsvWriter, error) {
+	c := &TCsvWriter{w: csv.NewWriter(w)}
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.Name
+	}
+	return c, c.w.Write(names)
+}
+
+func (c *TCsvWriter) Write(row []interface{}) error {
+	rec := make([]string, len(row))
+	for i, v := range row {
+		switch _v := v.(type) {
+		case string:
+			rec[i] = _v
+		case int64:
+			rec[i] = strconv.FormatInt(_v, 10)
+		case bool:
+			rec[i] = strconv.FormatBool(_v)
+		}
+	}
+	return c.w.Write(rec)
+}
+
+func (c *TCsvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// cnameChain returns the names the domain is an alias of, in order.
+func cnameChain(dinfo *TDomainInfo) []string {
+	var chain []string
+	prev := dinfo.Domain
+	for c := dinfo.Cname; c != nil; c = c.Cname {
+		if c.Domain != prev {
+			chain = append(chain, c.Domain)
+		}
+		prev = c.Domain
+	}
+	return chain
+}
+
+// exportAddrs returns the addresses of an entry of either result version.
+func exportAddrs(dinfo *TDomainInfo) []TAddrInfo {
+	if len(dinfo.Addrs) > 0 {
+		return dinfo.Addrs
+	}
+	allowed := make(map[string]bool)
+	for _, ip := range dinfo.AllowIp {
+		allowed[ip] = true
+	}
+	var addrs []TAddrInfo
+	for _, ip := range append(append([]string{}, dinfo.Ip4...), dinfo.Ip6...) {
+		addrs = append(addrs, TAddrInfo{Ip: ip, TGeoInfo: dinfo.Geo[ip], Allowed: allowed[ip]})
+	}
+	return addrs
+}
+
+func exportRows(t int64, dinfo *TDomainInfo, domains, ips TTableWriter) error {
+	chain := cnameChain(dinfo)
+	target := dinfo.Domain
+	if len(chain) > 0 {
+		target = chain[len(chain)-1]
+	}
+	var ip4, ip6, country []string
+	countries := make(map[string]bool)
+	for _, c := range dinfo.Country {
+		countries[c] = true
+		country = append(country, c)
+	}
+	for _, a := range exportAddrs(dinfo) {
+		family := int64(4)
+		if _a, err := netip.ParseAddr(a.Ip); err == nil && _a.Is6() {
+			family = 6
+			ip6 = append(ip6, a.Ip)
+		} else {
+			ip4 = append(ip4, a.Ip)
+		}
+		if a.Country != "" && !countries[a.Country] {
+			countries[a.Country] = true
+			country = append(country, a.Country)
+		}
+		err := ips.Write([]interface{}{t, dinfo.Domain, target, a.Ip, family, int64(a.Ttl),
+			a.Country, a.RegCountry, a.City, int64(a.Asn), a.Org, a.Register, a.Allowed,
+			dinfo.Profile, dinfo.Verdict})
+		if err != nil {
+			return err
+		}
+	}
+	return domains.Write([]interface{}{t, dinfo.Domain, dinfo.Rcode, dinfo.Error,
+		dinfo.Empty, dinfo.Ip6only, dinfo.Dnssec, dinfo.Rrsig,
+		dinfo.Allowed, dinfo.Drift, strings.Join(chain, ">"), target,
+		int64(len(ip4)), int64(len(ip6)), strings.Join(ip4, ","), strings.Join(ip6, ","),
+		strings.Join(country, ","), dinfo.Profile, dinfo.Verdict})
+}
+
+func createTable(filename, format string, cols []TColumn) (TTableWriter, *os.File, error) {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return nil, nil, err
+	}
+	var tw TTableWriter
+	if format == CExportParquet {
+		tw, err = NewParquetWriter(f, cols)
+	} else {
+		tw, err = NewCsvWriter(f, cols)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	return tw, f, nil
+}
+
+// ExportResult writes the <name>-domains and <name>-ips tables of a result
+// file or snapshot into dir and returns the number of domains.
+func ExportResult(filename, dir, format string) (int, error) {
+	if format != CExportCsv && format != CExportParquet {
+		return 0, fmt.Errorf("Unknown export format: %s", format)
+	}
+	name := filepath.Base(filename)
+	for _, ext := range []string{".gz", ".jsonl", ".json"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	r, err := openResult(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n := 0
+	var tables []*os.File
+	defer func() {
+		for _, f := range tables {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	domains, f, err := createTable(filepath.Join(dir, name+"-domains."+format), format, exportDomainColumns)
+	if err != nil {
+		return n, err
+	}
+	tables = append(tables, f)
+	ips, f, err := createTable(filepath.Join(dir, name+"-ips."+format), format, exportIPColumns)
+	if err != nil {
+		return n, err
+	}
+	tables = append(tables, f)
+	_, err = ReadResult(r, func(h *TResultHeader, dinfo *TDomainInfo) error {
+		n++
+		return exportRows(h.T, dinfo, domains, ips)
+	})
+	if err != nil {
+		return n, err
+	}
+	for i, tw := range []TTableWriter{domains, ips} {
+		if err := tw.Close(); err != nil {
+			return n, err
+		}
+		if _, err := commitFile(tables[i], strings.TrimSuffix(tables[i].Name(), ".tmp")); err != nil {
+			return n, err
+		}
+	}
+	tables = nil
+	return n, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// testExportResult writes a result with a CNAME chain, both families, an
+// allowlisted address and an error in the format and returns its name.
+func testExportResult(t *testing.T, dir, format, version string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	rw, err := NewResultWriter(&buf, format, version, 1700000000, testDump())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewDomainInfo("a.example")
+	a.Cname = &TDomainInfo{Domain: "a.example", Cname: &TDomainInfo{Domain: "cdn.example", Cname: &TDomainInfo{Domain: "edge.cdn.example"}}}
+	a.Rcode = "NOERROR"
+	a.Dnssec = true
+	a.Profile = "isp"
+	a.Verdict = CVerdictSinkhole
+	b := NewDomainInfo("b.example")
+	b.Rcode = "SERVFAIL"
+	b.Error = true
+	b.Verdict = CVerdictClean
+	if version == _ADDRS_VERSION_ {
+		a.Addrs = []TAddrInfo{
+			{Ip: "192.0.2.1", Ttl: 300, TGeoInfo: TGeoInfo{Country: "NL", RegCountry: "US", City: "Amsterdam", Asn: 64501, Org: "Example NL"}, Register: true},
+			{Ip: "2001:db8::1", Ttl: 60, Allowed: true},
+		}
+	} else {
+		a.Ip4 = []string{"192.0.2.1"}
+		a.Ip6 = []string{"2001:db8::1"}
+		a.Country = []string{"NL"}
+		a.AllowIp = []string{"2001:db8::1"}
+		a.Geo = map[string]TGeoInfo{"192.0.2.1": {Country: "NL", RegCountry: "US", City: "Amsterdam", Asn: 64501, Org: "Example NL"}}
+	}
+	rw.Put(a)
+	rw.Put(b)
+	if err := rw.Close(&TResolveStat{Domains: 2}); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "result."+format)
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func readCsv(t *testing.T, filename string) [][]string {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestExportCsv(t *testing.T) {
+	wantDomains := [][]string{
+		{"t", "domain", "rcode", "error", "empty", "ip6only", "dnssec", "rrsig", "allowed", "drift", "cname", "target", "ip4_count", "ip6_count", "ip4", "ip6", "country", "p", "vd"},
+		{"1700000000", "a.example", "NOERROR", "false", "false", "false", "true", "false", "false", "false", "cdn.example>edge.cdn.example", "edge.cdn.example", "1", "1", "192.0.2.1", "2001:db8::1", "NL", "isp", "sinkholed"},
+		{"1700000000", "b.example", "SERVFAIL", "true", "false", "false", "false", "false", "false", "false", "", "b.example", "0", "0", "", "", "", "", "clean"},
+	}
+	for _, format := range []string{CResultJson, CResultJsonl} {
+		for _, version := range []string{_DEFAULT_VERSION_, _ADDRS_VERSION_} {
+			dir := t.TempDir()
+			n, err := ExportResult(testExportResult(t, dir, format, version), dir, CExportCsv)
+			if err != nil || n != 2 {
+				t.Fatalf("%s %s: %d domains %v", format, version, n, err)
+			}
+			if rows := readCsv(t, filepath.Join(dir, "result-domains.csv")); !reflect.DeepEqual(rows, wantDomains) {
+				t.Errorf("%s %s domains:\n%q\nwant\n%q", format, version, rows, wantDomains)
+			}
+			rows := readCsv(t, filepath.Join(dir, "result-ips.csv"))
+			if len(rows) != 3 {
+				t.Fatalf("%s %s: %d ip rows", format, version, len(rows))
+			}
+			want := []string{"1700000000", "a.example", "edge.cdn.example", "192.0.2.1", "4", "300", "NL", "US", "Amsterdam", "64501", "Example NL", "true", "false", "isp", "sinkholed"}
+			if version == _DEFAULT_VERSION_ {
+				// 1.0 has no TTLs and register flags per address
+				want[5], want[11] = "0", "false"
+			}
+			if !reflect.DeepEqual(rows[1], want) {
+				t.Errorf("%s %s ip4 row %q, want %q", format, version, rows[1], want)
+			}
+			if rows[2][3] != "2001:db8::1" || rows[2][4] != "6" || rows[2][12] != "true" {
+				t.Errorf("%s %s ip6 row %q", format, version, rows[2])
+			}
+		}
+	}
+}
+
+func TestExportCompact(t *testing.T) {
+	dir := t.TempDir()
+	filename := testExportResult(t, dir, CResultJson, _DEFAULT_VERSION_)
+	dat, _ := ioutil.ReadFile(filename)
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, dat); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filename, buf.Bytes(), 0644)
+	if n, err := ExportResult(filename, dir, CExportCsv); err != nil || n != 2 {
+		t.Fatalf("compact json: %d domains %v", n, err)
+	}
+	if rows := readCsv(t, filepath.Join(dir, "result-domains.csv")); len(rows) != 3 {
+		t.Errorf("compact json: %d rows", len(rows))
+	}
+}
+
+func TestExportUnknown(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := ExportResult(testExportResult(t, dir, CResultJson, _DEFAULT_VERSION_), dir, "xlsx"); err == nil {
+		t.Error("unknown format exported")
+	}
+	if _, err := ExportResult(filepath.Join(dir, "missing.json"), dir, CExportCsv); err == nil {
+		t.Error("missing result exported")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("%d files left, want the result only", len(files))
+	}
+}
+
+// tcreader decodes the thrift compact protocol, structs become maps of
+// their field ids.
+type tcreader struct {
+	b []byte
+	p int
+}
+
+func (r *tcreader) varint() uint64 {
+	v, n := binary.Uvarint(r.b[r.p:])
+	r.p += n
+	return v
+}
+
+func (r *tcreader) value(typ byte) interface{} {
+	switch typ {
+	case 1, 2:
+		return typ == 1
+	case 3:
+		r.p++
+		return int64(int8(r.b[r.p-1]))
+	case 4, 5, 6:
+		v := r.varint()
+		return int64(v>>1) ^ -int64(v&1)
+	case 8:
+		n := int(r.varint())
+		r.p += n
+		return string(r.b[r.p-n : r.p])
+	case 9:
+		h := r.b[r.p]
+		r.p++
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.varint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case 12:
+		m := make(map[int16]interface{})
+		var id int16
+		for {
+			h := r.b[r.p]
+			r.p++
+			if h == 0 {
+				return m
+			}
+			if h>>4 == 0 {
+				id = int16(r.value(4).(int64))
+			} else {
+				id += int16(h >> 4)
+			}
+			m[id] = r.value(h & 0x0f)
+		}
+	}
+	panic(fmt.Sprintf("thrift compact type %d", typ))
+}
+
+// readParquet reads the rows of a file of the writer as the strings of the
+// csv export, the header first.
+func readParquet(t *testing.T, filename string) [][]string {
+	t.Helper()
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dat) < 12 || string(dat[:4]) != "PAR1" || string(dat[len(dat)-4:]) != "PAR1" {
+		t.Fatal("no parquet magic")
+	}
+	flen := int(binary.LittleEndian.Uint32(dat[len(dat)-8:]))
+	r := &tcreader{b: dat[len(dat)-8-flen : len(dat)-8]}
+	meta := r.value(12).(map[int16]interface{})
+	if r.p != flen {
+		t.Fatalf("footer of %d bytes, %d read", flen, r.p)
+	}
+	schema := meta[2].([]interface{})
+	var header []string
+	var types []int64
+	for _, e := range schema[1:] {
+		header = append(header, e.(map[int16]interface{})[4].(string))
+		types = append(types, e.(map[int16]interface{})[1].(int64))
+	}
+	if n := schema[0].(map[int16]interface{})[5].(int64); int(n) != len(header) {
+		t.Fatalf("root has %d children, %d columns", n, len(header))
+	}
+	rows := [][]string{header}
+	for _, g := range meta[4].([]interface{}) {
+		g := g.(map[int16]interface{})
+		nrows := int(g[3].(int64))
+		group := make([][]string, nrows)
+		for i := range group {
+			group[i] = make([]string, len(header))
+		}
+		for c, chunk := range g[1].([]interface{}) {
+			cm := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+			r := &tcreader{b: dat, p: int(cm[9].(int64))}
+			page := r.value(12).(map[int16]interface{})
+			if int(page[5].(map[int16]interface{})[1].(int64)) != nrows || int(cm[5].(int64)) != nrows {
+				t.Fatalf("column %s: rows don't match", header[c])
+			}
+			p := r.p
+			for i := 0; i < nrows; i++ {
+				switch types[c] {
+				case pqTypeInt64:
+					group[i][c] = strconv.FormatInt(int64(binary.LittleEndian.Uint64(dat[p:])), 10)
+					p += 8
+				case pqTypeBoolean:
+					group[i][c] = strconv.FormatBool(dat[r.p+i/8]>>uint(i%8)&1 == 1)
+				case pqTypeByteArray:
+					n := int(binary.LittleEndian.Uint32(dat[p:]))
+					group[i][c] = string(dat[p+4 : p+4+n])
+					p += 4 + n
+				}
+			}
+			if size := int(page[3].(int64)); types[c] != pqTypeBoolean && p-r.p != size {
+				t.Fatalf("column %s: %d value bytes, page of %d", header[c], p-r.p, size)
+			}
+		}
+		rows = append(rows, group...)
+	}
+	if n := int(meta[3].(int64)); n != len(rows)-1 {
+		t.Fatalf("%d rows, footer says %d", len(rows)-1, n)
+	}
+	return rows
+}
+
+func TestExportParquet(t *testing.T) {
+	for _, format := range []string{CResultJson, CResultJsonl} {
+		dir := t.TempDir()
+		filename := testExportResult(t, dir, format, _ADDRS_VERSION_)
+		for _, f := range []string{CExportCsv, CExportParquet} {
+			if n, err := ExportResult(filename, dir, f); err != nil || n != 2 {
+				t.Fatalf("%s %s: %d domains %v", format, f, n, err)
+			}
+		}
+		for _, table := range []string{"result-domains", "result-ips"} {
+			want := readCsv(t, filepath.Join(dir, table+".csv"))
+			if rows := readParquet(t, filepath.Join(dir, table+".parquet")); !reflect.DeepEqual(rows, want) {
+				t.Errorf("%s %s:\n%q\nwant\n%q", format, table, rows, want)
+			}
+		}
+	}
+}
+
+func TestParquetRows(t *testing.T) {
+	var buf bytes.Buffer
+	cols := []TColumn{{"n", CColInt}, {"s", CColString}, {"b", CColBool}}
+	p, err := NewParquetWriter(&buf, cols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"n", "s", "b"}}
+	for i := 0; i < 20; i++ {
+		if err := p.Write([]interface{}{int64(i - 10), fmt.Sprintf("row %d", i), i%3 == 0}); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, []string{strconv.Itoa(i - 10), fmt.Sprintf("row %d", i), strconv.FormatBool(i%3 == 0)})
+	}
+	if err := p.Write([]interface{}{int64(1)}); err == nil {
+		t.Error("short row written")
+	}
+	if err := p.Write([]interface{}{1.5, "x", true}); err == nil {
+		t.Error("float written")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "t.parquet")
+	ioutil.WriteFile(filename, buf.Bytes(), 0644)
+	if rows := readParquet(t, filename); !reflect.DeepEqual(rows, want) {
+		t.Errorf("got\n%q\nwant\n%q", rows, want)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"os"
+	"sort"
+)
+
+type TGeoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+} // Or any appropriate struct
+
+type TASNRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+type TGeoInfo struct {
+	Country    string `json:"c,omitempty"`
+	RegCountry string `json:"rc,omitempty"`
+	City       string `json:"city,omitempty"`
+	Asn        uint   `json:"asn,omitempty"`
+	Org        string `json:"org,omitempty"`
+}
+
+type TGeoConfig struct {
+	CountryFile string
+	CityFile    string
+	AsnFile     string
+	Home        string
+	TopN        uint
+}
+
+type TGeo struct {
+	TGeoConfig
+	country *maxminddb.Reader
+	city    *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+type TStatCount struct {
+	Key   string `json:"k"`
+	Name  string `json:"n,omitempty"`
+	Count uint   `json:"c"`
+}
+
+func openMMDB(filename string) *maxminddb.Reader {
+	if filename == "" {
+		return nil
+	}
+	db, err := maxminddb.Open(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Internal error, can't open MaxMindDB: %s\n", err.Error())
+		return nil
+	}
+	return db
+}
+
+// OpenGeo opens the configured GeoLite2 databases, a missing one only
+// leaves its fields empty.
+func OpenGeo(cfg TGeoConfig) *TGeo {
+	g := &TGeo{TGeoConfig: cfg}
+	g.city = openMMDB(cfg.CityFile)
+	if g.city == nil {
+		g.country = openMMDB(cfg.CountryFile)
+	}
+	g.asn = openMMDB(cfg.AsnFile)
+	return g
+}
+
+func (g *TGeo) Close() {
+	for _, db := range []*maxminddb.Reader{g.country, g.city, g.asn} {
+		if db != nil {
+			db.Close()
+		}
+	}
+}
+
+// Extended reports whether per address City or ASN data is available.
+func (g *TGeo) Extended() bool {
+	return g != nil && (g.city != nil || g.asn != nil)
+}
+
+// Lookup returns what the databases know about the address, ok is false
+// when nothing was found.
+func (g *TGeo) Lookup(addr string) (info TGeoInfo, ok bool) {
+	if g == nil {
+		return
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return
+	}
+	var r TGeoRecord
+	db := g.city
+	if db == nil {
+		db = g.country
+	}
+	if db != nil {
+		if _, found, err := db.LookupNetwork(ip, &r); err == nil && found {
+			info.Country = r.Country.ISOCode
+			info.RegCountry = r.RegisteredCountry.ISOCode
+			info.City = r.City.Names["en"]
+			ok = true
+		}
+	}
+	if g.asn != nil {
+		var a TASNRecord
+		if _, found, err := g.asn.LookupNetwork(ip, &a); err == nil && found && a.Number != 0 {
+			info.Asn = a.Number
+			info.Org = a.Organization
+			ok = true
+		}
+	}
+	return
+}
+
+func (stat *TResolveStat) countGeo(info TGeoInfo) {
+	if stat.countries == nil {
+		stat.countries = make(map[string]uint)
+		stat.asns = make(map[string]uint)
+		stat.orgs = make(map[string]string)
+	}
+	if info.Country != "" {
+		stat.countries[info.Country]++
+	}
+	if info.Asn != 0 {
+		_as := fmt.Sprintf("AS%d", info.Asn)
+		stat.asns[_as]++
+		stat.orgs[_as] = info.Org
+	}
+}
+
+func topCounts(m map[string]uint, names map[string]string, n uint) []TStatCount {
+	list := make([]TStatCount, 0, len(m))
+	for k, v := range m {
+		list = append(list, TStatCount{Key: k, Name: names[k], Count: v})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Key < list[j].Key
+	})
+	if uint(len(list)) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// Top fills the top-N country and ASN breakdowns of the resolved domains.
+func (stat *TResolveStat) Top(n uint) {
+	if n == 0 {
+		return
+	}
+	stat.TopCountry = topCounts(stat.countries, nil, n)
+	stat.TopAsn = topCounts(stat.asns, stat.orgs, n)
+}
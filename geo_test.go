@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// mmdbValue encodes v in the MaxMind DB data section format.
+func mmdbValue(buf *bytes.Buffer, v interface{}) {
+	ctrl := func(typ, size int) {
+		var extra []byte
+		switch {
+		case size < 29:
+		case size < 285:
+			size, extra = 29, []byte{byte(size - 29)}
+		default:
+			size, extra = 30, []byte{byte((size - 285) >> 8), byte(size - 285)}
+		}
+		if typ > 7 {
+			buf.WriteByte(byte(size))
+			buf.WriteByte(byte(typ - 7))
+		} else {
+			buf.WriteByte(byte(typ<<5 | size))
+		}
+		buf.Write(extra)
+	}
+	switch v := v.(type) {
+	case string:
+		ctrl(2, len(v))
+		buf.WriteString(v)
+	case uint:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(v))
+		_b := bytes.TrimLeft(b[:], "\x00")
+		ctrl(9, len(_b))
+		buf.Write(_b)
+	case []string:
+		ctrl(11, len(v))
+		for _, s := range v {
+			mmdbValue(buf, s)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ctrl(7, len(v))
+		for _, k := range keys {
+			mmdbValue(buf, k)
+			mmdbValue(buf, v[k])
+		}
+	}
+}
+
+type tmmdbNode struct {
+	child [2]*tmmdbNode
+	leaf  bool
+	data  int
+}
+
+// writeMMDB writes an IPv4 MaxMind DB with 24 bit records mapping the
+// networks to their records.
+func writeMMDB(t *testing.T, filename string, records map[string]map[string]interface{}) {
+	t.Helper()
+	var data bytes.Buffer
+	root := &tmmdbNode{}
+	for network, r := range records {
+		p := netip.MustParsePrefix(network)
+		ip := p.Addr().As4()
+		node := root
+		for i := 0; i < p.Bits(); i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if node.child[bit] == nil {
+				node.child[bit] = &tmmdbNode{}
+			}
+			node = node.child[bit]
+		}
+		node.leaf, node.data = true, data.Len()
+		mmdbValue(&data, r)
+	}
+	var nodes []*tmmdbNode
+	index := make(map[*tmmdbNode]int)
+	for queue := []*tmmdbNode{root}; len(queue) > 0; queue = queue[1:] {
+		index[queue[0]] = len(nodes)
+		nodes = append(nodes, queue[0])
+		for _, c := range queue[0].child {
+			if c != nil && !c.leaf {
+				queue = append(queue, c)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		for _, c := range node.child {
+			v := len(nodes)
+			if c != nil && c.leaf {
+				v = len(nodes) + 16 + c.data
+			} else if c != nil {
+				v = index[c]
+			}
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	mmdbValue(&buf, map[string]interface{}{
+		"binary_format_major_version": uint(2),
+		"binary_format_minor_version": uint(0),
+		"build_epoch":                 uint(0),
+		"database_type":               "rvz-test",
+		"description":                 map[string]interface{}{"en": "rvz test"},
+		"ip_version":                  uint(4),
+		"languages":                   []string{"en"},
+		"node_count":                  uint(len(nodes)),
+		"record_size":                 uint(24),
+	})
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func geoRecord(country, regcountry, city string) map[string]interface{} {
+	r := map[string]interface{}{
+		"country":            map[string]interface{}{"iso_code": country},
+		"registered_country": map[string]interface{}{"iso_code": regcountry},
+	}
+	if city != "" {
+		r["city"] = map[string]interface{}{"names": map[string]interface{}{"en": city}}
+	}
+	return r
+}
+
+func asnRecord(asn uint, org string) map[string]interface{} {
+	return map[string]interface{}{
+		"autonomous_system_number":       asn,
+		"autonomous_system_organization": org,
+	}
+}
+
+// testGeo writes the country and ASN databases of the tests, and the city
+// one when city is set.
+func testGeo(t *testing.T, city bool) TGeoConfig {
+	dir := t.TempDir()
+	cfg := TGeoConfig{
+		CountryFile: filepath.Join(dir, "country.mmdb"),
+		AsnFile:     filepath.Join(dir, "asn.mmdb"),
+		Home:        "RU",
+		TopN:        10,
+	}
+	writeMMDB(t, cfg.CountryFile, map[string]map[string]interface{}{
+		"192.0.2.0/24":    geoRecord("RU", "RU", ""),
+		"198.51.100.0/24": geoRecord("NL", "US", ""),
+	})
+	writeMMDB(t, cfg.AsnFile, map[string]map[string]interface{}{
+		"192.0.2.0/25":    asnRecord(64500, "Example RU"),
+		"198.51.100.0/24": asnRecord(64501, "Example NL"),
+	})
+	if city {
+		cfg.CityFile = filepath.Join(dir, "city.mmdb")
+		writeMMDB(t, cfg.CityFile, map[string]map[string]interface{}{
+			"192.0.2.0/24":    geoRecord("RU", "RU", "Moscow"),
+			"198.51.100.0/24": geoRecord("NL", "NL", "Amsterdam"),
+		})
+	}
+	return cfg
+}
+
+func TestGeoLookup(t *testing.T) {
+	g := OpenGeo(testGeo(t, false))
+	defer g.Close()
+	if !g.Extended() {
+		t.Fatal("ASN database is not extended")
+	}
+	for _, c := range []struct {
+		addr string
+		info TGeoInfo
+		ok   bool
+	}{
+		{"192.0.2.1", TGeoInfo{Country: "RU", RegCountry: "RU", Asn: 64500, Org: "Example RU"}, true},
+		{"192.0.2.200", TGeoInfo{Country: "RU", RegCountry: "RU"}, true},
+		{"198.51.100.7", TGeoInfo{Country: "NL", RegCountry: "US", Asn: 64501, Org: "Example NL"}, true},
+		{"203.0.113.1", TGeoInfo{}, false},
+		{"not an ip", TGeoInfo{}, false},
+	} {
+		info, ok := g.Lookup(c.addr)
+		if info != c.info || ok != c.ok {
+			t.Errorf("%s: got %+v %v, want %+v %v", c.addr, info, ok, c.info, c.ok)
+		}
+	}
+}
+
+func TestGeoCity(t *testing.T) {
+	g := OpenGeo(testGeo(t, true))
+	defer g.Close()
+	if g.country != nil {
+		t.Error("country database opened next to the city one")
+	}
+	info, ok := g.Lookup("198.51.100.7")
+	want := TGeoInfo{Country: "NL", RegCountry: "NL", City: "Amsterdam", Asn: 64501, Org: "Example NL"}
+	if !ok || info != want {
+		t.Errorf("got %+v %v, want %+v", info, ok, want)
+	}
+}
+
+func TestGeoMissing(t *testing.T) {
+	g := OpenGeo(TGeoConfig{CountryFile: filepath.Join(t.TempDir(), "missing.mmdb")})
+	defer g.Close()
+	if g.Extended() {
+		t.Error("no database is extended")
+	}
+	if _, ok := g.Lookup("192.0.2.1"); ok {
+		t.Error("lookup without a database")
+	}
+}
+
+func TestGeoHome(t *testing.T) {
+	cfg := testGeo(t, false)
+	g := OpenGeo(cfg)
+	defer g.Close()
+	rw, err := NewResultWriter(ioutil.Discard, CResultJson, _DEFAULT_VERSION_, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := &TResolveStat{Home: cfg.Home}
+	Uip4, Uip6 := make(map[string]TGeoInfo), make(map[string]TGeoInfo)
+	for _, d := range []struct {
+		domain string
+		ips    []string
+	}{
+		{"home.example", []string{"192.0.2.1", "192.0.2.2"}},
+		{"both.example", []string{"192.0.2.3", "198.51.100.1"}},
+		{"away.example", []string{"198.51.100.2"}},
+		{"unknown.example", []string{"203.0.113.1"}},
+	} {
+		dinfo := NewDomainInfo(d.domain)
+		dinfo.Ip4 = d.ips
+		PutRes(dinfo, rw, stat, g, nil, _DEFAULT_VERSION_, Uip4, Uip6)
+	}
+	if stat.Runet != 2 {
+		t.Errorf("runet %d, want 2", stat.Runet)
+	}
+	if stat.Ip4 != 4 || stat.Uip4 != 6 {
+		t.Errorf("ip4 %d uniq %d, want 4 and 6", stat.Ip4, stat.Uip4)
+	}
+	stat.Top(cfg.TopN)
+	wantc := []TStatCount{{Key: "NL", Count: 2}, {Key: "RU", Count: 2}}
+	if !equalCounts(stat.TopCountry, wantc) {
+		t.Errorf("top country %+v, want %+v", stat.TopCountry, wantc)
+	}
+	wanta := []TStatCount{{Key: "AS64500", Name: "Example RU", Count: 2}, {Key: "AS64501", Name: "Example NL", Count: 2}}
+	if !equalCounts(stat.TopAsn, wanta) {
+		t.Errorf("top asn %+v, want %+v", stat.TopAsn, wanta)
+	}
+}
+
+func TestGeoTopN(t *testing.T) {
+	stat := &TResolveStat{}
+	for _, c := range []string{"RU", "RU", "RU", "NL", "NL", "DE", "US", "US"} {
+		stat.countGeo(TGeoInfo{Country: c})
+	}
+	stat.countGeo(TGeoInfo{Asn: 64500, Org: "Example"})
+	stat.Top(0)
+	if stat.TopCountry != nil || stat.TopAsn != nil {
+		t.Error("top 0 is filled")
+	}
+	stat.Top(3)
+	want := []TStatCount{{Key: "RU", Count: 3}, {Key: "NL", Count: 2}, {Key: "US", Count: 2}}
+	if !equalCounts(stat.TopCountry, want) {
+		t.Errorf("top 3 %+v, want %+v", stat.TopCountry, want)
+	}
+	stat.Top(100)
+	if len(stat.TopCountry) != 4 || len(stat.TopAsn) != 1 {
+		t.Errorf("top 100 has %d countries and %d asns", len(stat.TopCountry), len(stat.TopAsn))
+	}
+}
+
+func equalCounts(a, b []TStatCount) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	CIPExportIpset string = "ipset"
+	CIPExportNft   string = "nft"
+	CIPExportTxt   string = "txt"
+)
+
+type TIPExport struct {
+	Dir       string
+	Name      string
+	Formats   []string
+	Aggregate bool
+	Mask4     int
+	Mask6     int
+	MaxElem   int
+	Allow     []netip.Prefix
+	Countries []string
+}
+
+// ParsePrefixes turns a list of addresses and CIDRs into prefixes, a bare
+// address becomes a host prefix.
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+		} else {
+			a, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+	return prefixes, nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, a netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *TIPExport) countryAllowed(country string) bool {
+	include := false
+	for _, c := range e.Countries {
+		if strings.HasPrefix(c, "!") {
+			if strings.EqualFold(c[1:], country) {
+				return false
+			}
+		} else {
+			include = true
+			if strings.EqualFold(c, country) {
+				return true
+			}
+		}
+	}
+	return !include
+}
+
+func (e *TIPExport) prefixes(uip map[string]TGeoInfo, mask int) []netip.Prefix {
+	list := make([]netip.Prefix, 0, len(uip))
+	for ip, info := range uip {
+		a, err := netip.ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+		a = a.Unmap()
+		if prefixesContain(e.Allow, a) || !e.countryAllowed(info.Country) {
+			continue
+		}
+		bits := a.BitLen()
+		if mask > 0 && mask < bits {
+			bits = mask
+		}
+		p, err := a.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		list = append(list, p)
+	}
+	if e.Aggregate || mask > 0 {
+		return AggregatePrefixes(list)
+	}
+	sort.Slice(list, func(i, j int) bool { return prefixLess(list[i], list[j]) })
+	return list
+}
+
+func prefixLess(a, b netip.Prefix) bool {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c < 0
+	}
+	return a.Bits() < b.Bits()
+}
+
+func prefixLast(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> uint(i%8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// AggregatePrefixes merges overlapping and adjacent prefixes of one address
+// family into the shortest list of CIDRs covering the same addresses.
+func AggregatePrefixes(list []netip.Prefix) []netip.Prefix {
+	if len(list) == 0 {
+		return list
+	}
+	sort.Slice(list, func(i, j int) bool { return prefixLess(list[i], list[j]) })
+	var res []netip.Prefix
+	start, end := list[0].Addr(), prefixLast(list[0])
+	for _, p := range list[1:] {
+		_last := prefixLast(p)
+		_next := end.Next()
+		if p.Addr().Compare(end) <= 0 || (_next.IsValid() && p.Addr() == _next) {
+			if _last.Compare(end) > 0 {
+				end = _last
+			}
+			continue
+		}
+		res = append(res, rangeToPrefixes(start, end)...)
+		start, end = p.Addr(), _last
+	}
+	return append(res, rangeToPrefixes(start, end)...)
+}
+
+func rangeToPrefixes(start, end netip.Addr) []netip.Prefix {
+	var res []netip.Prefix
+	for {
+		bits := start.BitLen()
+		for b := 0; b <= start.BitLen(); b++ {
+			p, _ := start.Prefix(b)
+			if p.Addr() == start && prefixLast(p).Compare(end) <= 0 {
+				bits = b
+				break
+			}
+		}
+		p := netip.PrefixFrom(start, bits)
+		res = append(res, p)
+		_last := prefixLast(p)
+		if _last.Compare(end) >= 0 {
+			break
+		}
+		start = _last.Next()
+	}
+	return res
+}
+
+// writeIpset creates the sets with the fixed maxelem, ipset create -exist
+// fails on an existing set made with another one.
+func writeIpset(filename, name string, maxelem int, p4, p6 []netip.Prefix) error {
+	if len(p4) > maxelem || len(p6) > maxelem {
+		return fmt.Errorf("IP export of %d/%d prefixes is over ipset maxelem %d", len(p4), len(p6), maxelem)
+	}
+	return writeLines(filename, func(w *bufio.Writer) {
+		for _, s := range []struct {
+			name, family string
+			list         []netip.Prefix
+		}{{name + "4", "inet", p4}, {name + "6", "inet6", p6}} {
+			_tmp := s.name + "-tmp"
+			fmt.Fprintf(w, "create %s hash:net family %s maxelem %d -exist\n", s.name, s.family, maxelem)
+			fmt.Fprintf(w, "create %s hash:net family %s maxelem %d -exist\n", _tmp, s.family, maxelem)
+			fmt.Fprintf(w, "flush %s\n", _tmp)
+			for _, p := range s.list {
+				fmt.Fprintf(w, "add %s %s\n", _tmp, p)
+			}
+			fmt.Fprintf(w, "swap %s %s\n", _tmp, s.name)
+			fmt.Fprintf(w, "destroy %s\n", _tmp)
+		}
+	})
+}
+
+func writeNft(filename, name string, p4, p6 []netip.Prefix) error {
+	return writeLines(filename, func(w *bufio.Writer) {
+		fmt.Fprintf(w, "table inet %s {\n", name)
+		fmt.Fprintf(w, "\tset %s4 {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t}\n", name)
+		fmt.Fprintf(w, "\tset %s6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t}\n", name)
+		fmt.Fprint(w, "}\n")
+		for _, s := range []struct {
+			name string
+			list []netip.Prefix
+		}{{name + "4", p4}, {name + "6", p6}} {
+			fmt.Fprintf(w, "flush set inet %s %s\n", name, s.name)
+			if len(s.list) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "add element inet %s %s {\n", name, s.name)
+			for i, p := range s.list {
+				if i < len(s.list)-1 {
+					fmt.Fprintf(w, "\t%s,\n", p)
+				} else {
+					fmt.Fprintf(w, "\t%s\n", p)
+				}
+			}
+			fmt.Fprint(w, "}\n")
+		}
+	})
+}
+
+func writeTxt(filename string, list []netip.Prefix) error {
+	return writeLines(filename, func(w *bufio.Writer) {
+		for _, p := range list {
+			if p.IsSingleIP() {
+				fmt.Fprintf(w, "%s\n", p.Addr())
+			} else {
+				fmt.Fprintf(w, "%s\n", p)
+			}
+		}
+	})
+}
+
+// ExportIPs writes the unique resolved addresses as firewall blocklists in
+// the configured formats.
+func ExportIPs(e *TIPExport, Uip4, Uip6 map[string]TGeoInfo) error {
+	p4 := e.prefixes(Uip4, e.Mask4)
+	p6 := e.prefixes(Uip6, e.Mask6)
+	for _, format := range e.Formats {
+		var err error
+		base := filepath.Join(e.Dir, e.Name)
+		switch format {
+		case CIPExportIpset:
+			err = writeIpset(base+".ipset", e.Name, e.MaxElem, p4, p6)
+		case CIPExportNft:
+			err = writeNft(base+".nft", e.Name, p4, p6)
+		case CIPExportTxt:
+			err = writeTxt(base+"-ip4.txt", p4)
+			if err == nil {
+				err = writeTxt(base+"-ip6.txt", p6)
+			}
+		default:
+			err = fmt.Errorf("Unknown IP export format: %s", format)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testPrefixes(t *testing.T, list ...string) []netip.Prefix {
+	t.Helper()
+	prefixes, err := ParsePrefixes(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefixes
+}
+
+func TestAggregatePrefixes(t *testing.T) {
+	for _, c := range []struct {
+		list, want []string
+	}{
+		{nil, nil},
+		{[]string{"192.0.2.0/25", "192.0.2.128/25"}, []string{"192.0.2.0/24"}},
+		{[]string{"192.0.2.2", "192.0.2.1"}, []string{"192.0.2.1/32", "192.0.2.2/32"}},
+		{[]string{"192.0.2.5", "192.0.2.0/24"}, []string{"192.0.2.0/24"}},
+		{[]string{"192.0.2.2/31", "10.0.0.0/8", "192.0.2.1", "192.0.2.0"}, []string{"10.0.0.0/8", "192.0.2.0/30"}},
+		{[]string{"192.0.2.0/24", "192.0.3.0/24", "192.0.4.0/24"}, []string{"192.0.2.0/23", "192.0.4.0/24"}},
+		{[]string{"255.255.255.255", "255.255.255.254"}, []string{"255.255.255.254/31"}},
+		{[]string{"2001:db8:8000::/33", "2001:db8::/33", "2001:db8::1"}, []string{"2001:db8::/32"}},
+	} {
+		var got []string
+		for _, p := range AggregatePrefixes(testPrefixes(t, c.list...)) {
+			got = append(got, p.String())
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: %v, want %v", c.list, got, c.want)
+		}
+	}
+}
+
+func testExport(dir string, maxelem int) *TIPExport {
+	return &TIPExport{
+		Dir:       dir,
+		Name:      "rvz",
+		Formats:   []string{CIPExportIpset, CIPExportNft, CIPExportTxt},
+		MaxElem:   maxelem,
+		Allow:     []netip.Prefix{netip.MustParsePrefix("192.0.2.128/25")},
+		Countries: []string{"!CN"},
+	}
+}
+
+var (
+	testUip4 = map[string]TGeoInfo{
+		"192.0.2.2":    {Country: "RU"},
+		"192.0.2.1":    {Country: "RU"},
+		"192.0.2.200":  {Country: "RU"},
+		"198.51.100.7": {Country: "CN"},
+		"203.0.113.9":  {Country: "US"},
+	}
+	testUip6 = map[string]TGeoInfo{"2001:db8::1": {}}
+)
+
+func readFile(t *testing.T, filename string) string {
+	t.Helper()
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(dat)
+}
+
+func TestExportIPs(t *testing.T) {
+	dir := t.TempDir()
+	if err := ExportIPs(testExport(dir, 3), testUip4, testUip6); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"rvz.ipset": `create rvz4 hash:net family inet maxelem 3 -exist
+create rvz4-tmp hash:net family inet maxelem 3 -exist
+flush rvz4-tmp
+add rvz4-tmp 192.0.2.1/32
+add rvz4-tmp 192.0.2.2/32
+add rvz4-tmp 203.0.113.9/32
+swap rvz4-tmp rvz4
+destroy rvz4-tmp
+create rvz6 hash:net family inet6 maxelem 3 -exist
+create rvz6-tmp hash:net family inet6 maxelem 3 -exist
+flush rvz6-tmp
+add rvz6-tmp 2001:db8::1/128
+swap rvz6-tmp rvz6
+destroy rvz6-tmp
+`,
+		"rvz.nft": `table inet rvz {
+	set rvz4 {
+		type ipv4_addr
+		flags interval
+	}
+	set rvz6 {
+		type ipv6_addr
+		flags interval
+	}
+}
+flush set inet rvz rvz4
+add element inet rvz rvz4 {
+	192.0.2.1/32,
+	192.0.2.2/32,
+	203.0.113.9/32
+}
+flush set inet rvz rvz6
+add element inet rvz rvz6 {
+	2001:db8::1/128
+}
+`,
+		"rvz-ip4.txt": "192.0.2.1\n192.0.2.2\n203.0.113.9\n",
+		"rvz-ip6.txt": "2001:db8::1\n",
+	} {
+		if got := readFile(t, filepath.Join(dir, name)); got != want {
+			t.Errorf("%s:\n%s\nwant\n%s", name, got, want)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(files) > 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+}
+
+func TestExportIPsMask(t *testing.T) {
+	dir := t.TempDir()
+	e := testExport(dir, 3)
+	e.Formats = []string{CIPExportTxt}
+	e.Mask4, e.Mask6 = 24, 48
+	if err := ExportIPs(e, testUip4, testUip6); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "rvz-ip4.txt")); got != "192.0.2.0/24\n203.0.113.0/24\n" {
+		t.Errorf("ip4 %q", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "rvz-ip6.txt")); got != "2001:db8::/48\n" {
+		t.Errorf("ip6 %q", got)
+	}
+}
+
+func TestExportIPsMaxElem(t *testing.T) {
+	dir := t.TempDir()
+	if err := ExportIPs(testExport(dir, 3), testUip4, testUip6); err != nil {
+		t.Fatal(err)
+	}
+	before := readFile(t, filepath.Join(dir, "rvz.ipset"))
+	err := ExportIPs(testExport(dir, 2), testUip4, testUip6)
+	if err == nil || !strings.Contains(err.Error(), "maxelem 2") {
+		t.Fatalf("3 prefixes with maxelem 2: %v", err)
+	}
+	// The sets loaded before stay as they are.
+	if got := readFile(t, filepath.Join(dir, "rvz.ipset")); got != before {
+		t.Errorf("ipset file changed:\n%s", got)
+	}
+	e := testExport(dir, 3)
+	e.Formats = []string{"iptables"}
+	if err := ExportIPs(e, testUip4, testUip6); err == nil {
+		t.Error("unknown format: no error")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+type TIPIndexEntry struct {
+	Ip string `json:"ip"`
+	TGeoInfo
+	Domains []string `json:"d"`
+}
+
+type TIPIndex struct {
+	T    int64           `json:"t"`
+	List []TIPIndexEntry `json:"list"`
+}
+
+func (stat *TResolveStat) indexIP(ip, domain string) {
+	if stat.ipindex == nil {
+		stat.ipindex = make(map[string][]string)
+	}
+	stat.ipindex[ip] = append(stat.ipindex[ip], domain)
+}
+
+// WriteIPIndex writes the address to domains index of the pass, the
+// addresses carrying the most domains first.
+func WriteIPIndex(filename string, t int64, index map[string][]string, Uip4, Uip6 map[string]TGeoInfo) error {
+	idx := TIPIndex{T: t, List: make([]TIPIndexEntry, 0, len(index))}
+	for ip, domains := range index {
+		info, ok := Uip4[ip]
+		if !ok {
+			info = Uip6[ip]
+		}
+		sort.Strings(domains)
+		idx.List = append(idx.List, TIPIndexEntry{Ip: ip, TGeoInfo: info, Domains: domains})
+	}
+	sort.Slice(idx.List, func(i, j int) bool {
+		if len(idx.List[i].Domains) != len(idx.List[j].Domains) {
+			return len(idx.List[i].Domains) > len(idx.List[j].Domains)
+		}
+		return idx.List[i].Ip < idx.List[j].Ip
+	})
+	dat, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return writeLines(filename, func(w *bufio.Writer) {
+		w.Write(dat)
+		w.WriteString("\n")
+	})
+}
+
+func ReadIPIndex(filename string) (*TIPIndex, error) {
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	idx := &TIPIndex{}
+	if err = json.Unmarshal(dat, idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func printIPIndexEntry(e TIPIndexEntry, full bool) {
+	_as := "-"
+	if e.Asn != 0 {
+		_as = fmt.Sprintf("AS%d", e.Asn)
+	}
+	fmt.Printf("%s\t%d\t%s\t%s\t%s", e.Ip, len(e.Domains), e.Country, _as, e.Org)
+	if full {
+		fmt.Printf("\t%s", strings.Join(e.Domains, ","))
+	}
+	fmt.Print("\n")
+}
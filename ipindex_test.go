@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIPIndex(t *testing.T) {
+	dir := t.TempDir()
+	g := OpenGeo(testGeo(t, false))
+	defer g.Close()
+	allowfile := filepath.Join(dir, "allow.txt")
+	if err := ioutil.WriteFile(allowfile, []byte("203.0.113.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	allow, err := ReadAllowList(allowfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, err := NewResultWriter(ioutil.Discard, CResultJson, _DEFAULT_VERSION_, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := &TResolveStat{}
+	Uip4, Uip6 := make(map[string]TGeoInfo), make(map[string]TGeoInfo)
+	for _, d := range []struct {
+		domain   string
+		ip4, ip6 []string
+	}{
+		{"c.example", []string{"198.51.100.7", "192.0.2.1", "203.0.113.5"}, nil},
+		{"a.example", []string{"192.0.2.1"}, []string{"2001:db8::1"}},
+		{"b.example", []string{"192.0.2.1", "198.51.100.7"}, nil},
+	} {
+		dinfo := NewDomainInfo(d.domain)
+		dinfo.Ip4 = d.ip4
+		dinfo.Ip6 = append(dinfo.Ip6, d.ip6...)
+		PutRes(dinfo, rw, stat, g, allow, _DEFAULT_VERSION_, Uip4, Uip6)
+	}
+	filename := filepath.Join(dir, "ipindex.json")
+	if err := WriteIPIndex(filename, 1700000000, stat.ipindex, Uip4, Uip6); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ReadIPIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The allowlisted address is not indexed, the most shared first.
+	want := &TIPIndex{T: 1700000000, List: []TIPIndexEntry{
+		{Ip: "192.0.2.1", TGeoInfo: TGeoInfo{Country: "RU", RegCountry: "RU", Asn: 64500, Org: "Example RU"}, Domains: []string{"a.example", "b.example", "c.example"}},
+		{Ip: "198.51.100.7", TGeoInfo: TGeoInfo{Country: "NL", RegCountry: "US", Asn: 64501, Org: "Example NL"}, Domains: []string{"b.example", "c.example"}},
+		{Ip: "2001:db8::1", Domains: []string{"a.example"}},
+	}}
+	if !reflect.DeepEqual(idx, want) {
+		t.Errorf("index %+v\nwant %+v", idx, want)
+	}
+
+	// An empty pass has an empty list.
+	if err := WriteIPIndex(filename, 1700000001, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err := ReadIPIndex(filename); err != nil || idx.List == nil || len(idx.List) != 0 {
+		t.Errorf("empty index %+v %v", idx, err)
+	}
+}
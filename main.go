@@ -4,37 +4,72 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 )
 
-var Cfg *Config
+// Conf is the configuration, ConfErr why it could not be loaded.
+var Conf *TConfig
+var ConfErr error
 
 func main() {
 	conffile := flag.String("c", "revizorro.conf", "Configuration file")
+	conflags := ConfigFlags(flag.CommandLine, os.Args[1:])
 	flag.Parse()
-	Cfg, _ = ReadConfigFile(*conffile)
-
-	_url := Cfg.GetString("APIURL", "https://proxy-01.eais-upload.451f.cc")
-	_key := Cfg.GetString("APIKey", "****")
-	_workdir := Cfg.GetString("workdir", "/tmp")
-	_results := Cfg.GetString("results", "/tmp")
+	_flags := conflags()
+	_cfg, err := ReadConfigFile(*conffile)
+	_explicit := false
+	flag.Visit(func(f *flag.Flag) { _explicit = _explicit || f.Name == "c" })
+	if err != nil && (_explicit || !os.IsNotExist(err)) {
+		ConfErr = err
+	} else {
+		Conf, ConfErr = LoadConfig(_cfg, _flags)
+	}
+	if flag.NArg() > 0 {
+		os.Exit(RunCommand(flag.Args()))
+	}
+	if ConfErr == nil {
+		ConfErr = Conf.Validate()
+	}
+	if ConfErr != nil {
+		for _, _e := range strings.Split(ConfErr.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", _e)
+		}
+		os.Exit(1)
+	}
 
+	_workdir := Conf.Workdir
 	_curdumpfile := fmt.Sprintf("%s/current", _workdir)
 	_dumpfile := fmt.Sprintf("%s/dump.zip", _workdir)
 	_xmldump := fmt.Sprintf("%s/dump.xml", _workdir)
 	_domains := fmt.Sprintf("%s/domains.lst", _workdir)
-	_mmdbfile := fmt.Sprintf("%s/GeoLite2-Country.mmdb", _workdir)
+	_regips := fmt.Sprintf("%s/domains.ip", _workdir)
+	_added := fmt.Sprintf("%s/domains.added", _workdir)
+	_removed := fmt.Sprintf("%s/domains.removed", _workdir)
 
-	_dnshost := Cfg.GetString("dnshost", "127.0.0.1")
-	_dnsport := Cfg.GetString("dnsport", "53")
+	d, err := NewDaemon(Conf, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	_lastrefresh := time.Now()
+	var _lastfull time.Time
 
-	_maxpool := Cfg.GetUint("maxpool", 100)
-	_nextpool := Cfg.GetUint("nextpool", 80)
-	_forcecount := Cfg.GetUint("forcecount", 0)
+	// SIGHUP reloads the config at the next pass boundary.
+	_hup := make(chan os.Signal, 1)
+	signal.Notify(_hup, syscall.SIGHUP)
 
 	for {
-		dump, err := GetLastDumpId(_url, _key)
+		select {
+		case <-_hup:
+			d = ReloadConfig(d, *conffile, _explicit, _flags)
+			Conf = d.Conf
+		default:
+		}
+		dump, err := GetLastDumpId(Conf.APIURL, Conf.APIKey)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
 		}
@@ -48,7 +83,7 @@ func main() {
 		} else if dump.CRC != "" && dump.CRC != cur.CRC {
 			fmt.Println("Get new file!")
 			l := memTest()
-			err := FetchDump(dump.Id, _dumpfile, _url, _key)
+			err := FetchDump(dump.Id, _dumpfile, Conf.APIURL, Conf.APIKey)
 			if l != memTest() {
 				fmt.Fprintf(os.Stderr, "Memory leak %s\n", "FetchDump")
 			}
@@ -60,12 +95,28 @@ func main() {
 				}
 				if err == nil {
 					l = memTest()
-					err = ParseDomains(_xmldump, _domains)
+					if d.RPZ != nil {
+						d.RPZ.Serial = RPZSerial(dump)
+					}
+					err = ParseDomains(_xmldump, _domains, _regips, _added, _removed, d.RPZ, d.Allow)
 					if l != memTest() {
 						fmt.Fprintf(os.Stderr, "Memory leak %s\n", "ParseDomains")
 					}
 					if err == nil {
 						err = WriteCurrentDumpId(_curdumpfile, dump)
+						// The added domains are resolved at once only when
+						// the full pass is not due anyway.
+						_due := d.FullInterval == 0 || time.Since(_lastfull) >= d.FullInterval
+						if fi, _err := os.Stat(_added); d.Urgent && !_due && _err == nil && fi.Size() > 0 {
+							_u := *d.Resolve
+							_u.Name = "urgent"
+							_u.DomainsFile = _added
+							_u.IPExport = nil
+							_u.Refresh = true
+							if err := ResolveList(&_u, dump); err != nil {
+								fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+							}
+						}
 					} else {
 						fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
 					}
@@ -84,9 +135,21 @@ func main() {
 		} else {
 			fmt.Fprint(os.Stderr, "Not changed!\n")
 		}
+		if time.Since(_lastfull) < d.FullInterval {
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		_lastfull = time.Now()
 		l := memTest()
 		ig := runtime.NumGoroutine()
-		err = ResolveList(_dnshost, _dnsport, _domains, _mmdbfile, _workdir, _results, _maxpool, _nextpool, _forcecount, cur)
+		d.Resolve.Refresh = d.ForceRefresh > 0 && time.Since(_lastrefresh) >= d.ForceRefresh
+		if d.Resolve.Refresh {
+			_lastrefresh = time.Now()
+		}
+		err = ResolveList(d.Resolve, cur)
+		if _err := ApplyRetention(Conf.Results, d.Retention); _err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", _err.Error())
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
 			time.Sleep(10 * time.Second)
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TResultOutput writes the result once into the plain result file and
+// the gzip snapshot at the same time. Nothing is visible under the final
+// names until Commit has synced both files.
+type TResultOutput struct {
+	W        *bufio.Writer
+	plain    *os.File
+	packed   *os.File
+	gz       *gzip.Writer
+	hplain   hash.Hash
+	hpacked  hash.Hash
+	resfile  string
+	seqfile  string
+	finished bool
+}
+
+type TManifest struct {
+	File        string `json:"file"`
+	Format      string `json:"format"`
+	T           int64  `json:"t"`
+	Size        int64  `json:"size"`
+	Sha256      string `json:"sha256"`
+	PlainSize   int64  `json:"plain_size"`
+	PlainSha256 string `json:"plain_sha256"`
+}
+
+func CreateResultOutput(resfile, seqfile string) (*TResultOutput, error) {
+	o := &TResultOutput{resfile: resfile, seqfile: seqfile, hplain: sha256.New(), hpacked: sha256.New()}
+	var err error
+	if o.plain, err = os.Create(resfile + ".tmp"); err != nil {
+		return nil, err
+	}
+	if o.packed, err = os.Create(seqfile + ".tmp"); err != nil {
+		o.plain.Close()
+		os.Remove(resfile + ".tmp")
+		return nil, err
+	}
+	o.gz = gzip.NewWriter(io.MultiWriter(o.packed, o.hpacked))
+	o.W = bufio.NewWriter(io.MultiWriter(o.plain, o.hplain, o.gz))
+	return o, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// commitFile syncs and closes the temporary file and renames it to the
+// final name, syncing the directory after.
+func commitFile(f *os.File, filename string) (int64, error) {
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err = f.Close(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(f.Name(), filename); err != nil {
+		return 0, err
+	}
+	return fi.Size(), syncDir(filepath.Dir(filename))
+}
+
+// writeLines writes a file through write, it replaces filename once
+// complete.
+func writeLines(filename string, write func(w *bufio.Writer)) error {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	write(w)
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	_, err = commitFile(f, filename)
+	return err
+}
+
+// Commit finishes both streams and moves them under their final names.
+func (o *TResultOutput) Commit(t int64) (*TManifest, error) {
+	o.finished = true
+	defer o.cleanup()
+	if err := o.W.Flush(); err != nil {
+		return nil, err
+	}
+	if err := o.gz.Close(); err != nil {
+		return nil, err
+	}
+	m := &TManifest{
+		File:        filepath.Base(o.seqfile),
+		T:           t,
+		Sha256:      hex.EncodeToString(o.hpacked.Sum(nil)),
+		PlainSha256: hex.EncodeToString(o.hplain.Sum(nil)),
+	}
+	var err error
+	if m.PlainSize, err = commitFile(o.plain, o.resfile); err != nil {
+		return nil, err
+	}
+	if m.Size, err = commitFile(o.packed, o.seqfile); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Abort drops the temporary files of an unfinished output.
+func (o *TResultOutput) Abort() {
+	if o.finished {
+		return
+	}
+	o.finished = true
+	o.cleanup()
+}
+
+func (o *TResultOutput) cleanup() {
+	for _, f := range []*os.File{o.plain, o.packed} {
+		f.Close()
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			os.Remove(f.Name())
+		}
+	}
+}
+
+// ManifestFile is the manifest name of a snapshot: <ts>[-kind].manifest.json
+func ManifestFile(seqfile string) string {
+	return strings.TrimSuffix(seqfile, ".gz") + ".manifest.json"
+}
+
+func WriteManifest(seqfile string, m *TManifest) error {
+	dat, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	filename := ManifestFile(seqfile)
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(append(dat, '\n')); err != nil {
+		return err
+	}
+	_, err = commitFile(f, filename)
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func dirFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sha256Hex(dat []byte) string {
+	sum := sha256.Sum256(dat)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestResultOutputCommit(t *testing.T) {
+	dir := t.TempDir()
+	resfile, seqfile := filepath.Join(dir, "result.json"), filepath.Join(dir, "1700000000.gz")
+	o, err := CreateResultOutput(resfile, seqfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("{\"d\":\"a.example\"}\n", 1000)
+	o.W.WriteString(body)
+	m, err := o.Commit(1700000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Abort()
+	if err := WriteManifest(seqfile, m); err != nil {
+		t.Fatal(err)
+	}
+	if got := dirFiles(t, dir); !reflect.DeepEqual(got, []string{"1700000000.gz", "1700000000.manifest.json", "result.json"}) {
+		t.Fatalf("files %v", got)
+	}
+	plain := []byte(readFile(t, resfile))
+	packed := []byte(readFile(t, seqfile))
+	zr, err := gzip.NewReader(bytes.NewReader(packed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked, err := ioutil.ReadAll(zr)
+	if err != nil || string(plain) != body || string(unpacked) != body {
+		t.Fatalf("plain %d bytes, packed %d bytes unpacked to %d: %v", len(plain), len(packed), len(unpacked), err)
+	}
+	want := TManifest{File: "1700000000.gz", T: 1700000000, Size: int64(len(packed)), Sha256: sha256Hex(packed),
+		PlainSize: int64(len(plain)), PlainSha256: sha256Hex(plain)}
+	var _m TManifest
+	if err := json.Unmarshal([]byte(readFile(t, ManifestFile(seqfile))), &_m); err != nil || _m != want {
+		t.Errorf("manifest %+v %v\nwant %+v", _m, err, want)
+	}
+}
+
+func TestResultOutputAbort(t *testing.T) {
+	dir := t.TempDir()
+	resfile, seqfile := filepath.Join(dir, "result.json"), filepath.Join(dir, "1700000001.gz")
+	// The result of the pass before stays.
+	if err := ioutil.WriteFile(resfile, []byte("previous\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o, err := CreateResultOutput(resfile, seqfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Halfway, with some of it already flushed to the files.
+	o.W.WriteString(strings.Repeat("{\"d\":\"a.example\"}\n", 10000))
+	if err := o.W.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dirFiles(t, dir); !reflect.DeepEqual(got, []string{"1700000001.gz.tmp", "result.json", "result.json.tmp"}) {
+		t.Fatalf("files while writing %v", got)
+	}
+	o.Abort()
+	o.Abort()
+	if got := dirFiles(t, dir); !reflect.DeepEqual(got, []string{"result.json"}) {
+		t.Errorf("files after abort %v", got)
+	}
+	if got := readFile(t, resfile); got != "previous\n" {
+		t.Errorf("result %q", got)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A minimal Parquet writer: flat schema, REQUIRED columns, PLAIN encoded
+// uncompressed data pages, one page per column chunk. It is enough for
+// DuckDB, Spark and pandas to read the export without any dependency.
+
+const (
+	CParquetRowGroup = 100000
+
+	pqTypeBoolean   = 0
+	pqTypeInt64     = 2
+	pqTypeByteArray = 6
+	pqConvertedUTF8 = 0
+	pqRequired      = 0
+	pqEncodingPlain = 0
+	pqEncodingRLE   = 3
+	pqPageData      = 0
+	pqCodecNone     = 0
+
+	// thrift compact protocol types
+	tcI32    = 5
+	tcI64    = 6
+	tcBinary = 8
+	tcList   = 9
+	tcStruct = 12
+)
+
+// tcompact encodes thrift structures with the compact protocol.
+type tcompact struct {
+	b     bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func (t *tcompact) varint(v uint64) {
+	var _b [binary.MaxVarintLen64]byte
+	t.b.Write(_b[:binary.PutUvarint(_b[:], v)])
+}
+
+func (t *tcompact) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *tcompact) field(id int16, typ byte) {
+	if d := id - t.last; d > 0 && d <= 15 {
+		t.b.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.b.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+	t.last = id
+}
+
+func (t *tcompact) i32(id int16, v int32) {
+	t.field(id, tcI32)
+	t.zigzag(int64(v))
+}
+
+func (t *tcompact) i64(id int16, v int64) {
+	t.field(id, tcI64)
+	t.zigzag(v)
+}
+
+func (t *tcompact) str(s string) {
+	t.varint(uint64(len(s)))
+	t.b.WriteString(s)
+}
+
+func (t *tcompact) binary(id int16, s string) {
+	t.field(id, tcBinary)
+	t.str(s)
+}
+
+func (t *tcompact) list(id int16, elem byte, n int) {
+	t.field(id, tcList)
+	if n < 15 {
+		t.b.WriteByte(byte(n)<<4 | elem)
+		return
+	}
+	t.b.WriteByte(0xf0 | elem)
+	t.varint(uint64(n))
+}
+
+// begin opens a struct, as a field when id > 0 or as a list element.
+func (t *tcompact) begin(id int16) {
+	if id > 0 {
+		t.field(id, tcStruct)
+	}
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *tcompact) end() {
+	t.b.WriteByte(0)
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+type TColumn struct {
+	Name string
+	Kind int
+}
+
+const (
+	CColString = iota
+	CColInt
+	CColBool
+)
+
+type pqChunk struct {
+	offset int64
+	size   int64
+}
+
+type pqRowGroup struct {
+	rows   int64
+	size   int64
+	chunks []pqChunk
+}
+
+type TParquetWriter struct {
+	w      *bufio.Writer
+	offset int64
+	cols   []TColumn
+	data   []bytes.Buffer
+	rows   int64
+	total  int64
+	groups []pqRowGroup
+	err    error
+}
+
+func NewParquetWriter(w io.Writer, cols []TColumn) (*TParquetWriter, error) {
+	p := &TParquetWriter{w: bufio.NewWriter(w), cols: cols, data: make([]bytes.Buffer, len(cols))}
+	p.write([]byte("PAR1"))
+	return p, p.err
+}
+
+func (p *TParquetWriter) write(b []byte) {
+	if p.err != nil {
+		return
+	}
+	var n int
+	n, p.err = p.w.Write(b)
+	p.offset += int64(n)
+}
+
+// Write adds a row, the values are string, int64 or bool as the columns.
+func (p *TParquetWriter) Write(row []interface{}) error {
+	if len(row) != len(p.cols) {
+		return fmt.Errorf("Parquet row has %d values, %d columns", len(row), len(p.cols))
+	}
+	for i, v := range row {
+		d := &p.data[i]
+		switch _v := v.(type) {
+		case string:
+			var l [4]byte
+			binary.LittleEndian.PutUint32(l[:], uint32(len(_v)))
+			d.Write(l[:])
+			d.WriteString(_v)
+		case int64:
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], uint64(_v))
+			d.Write(b[:])
+		case bool:
+			// packed in flush
+			if _v {
+				d.WriteByte(1)
+			} else {
+				d.WriteByte(0)
+			}
+		default:
+			return fmt.Errorf("Parquet column %s: unsupported value %T", p.cols[i].Name, v)
+		}
+	}
+	p.rows++
+	if p.rows >= CParquetRowGroup {
+		p.flush()
+	}
+	return p.err
+}
+
+func packBools(b []byte) []byte {
+	res := make([]byte, (len(b)+7)/8)
+	for i, v := range b {
+		if v != 0 {
+			res[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return res
+}
+
+// flush writes the buffered rows as a row group.
+func (p *TParquetWriter) flush() {
+	if p.rows == 0 || p.err != nil {
+		return
+	}
+	g := pqRowGroup{rows: p.rows}
+	for i := range p.cols {
+		values := p.data[i].Bytes()
+		if p.cols[i].Kind == CColBool {
+			values = packBools(values)
+		}
+		var h tcompact
+		h.i32(1, pqPageData)
+		h.i32(2, int32(len(values)))
+		h.i32(3, int32(len(values)))
+		h.begin(5)
+		h.i32(1, int32(p.rows))
+		h.i32(2, pqEncodingPlain)
+		h.i32(3, pqEncodingRLE)
+		h.i32(4, pqEncodingRLE)
+		h.end()
+		h.b.WriteByte(0)
+		c := pqChunk{offset: p.offset, size: int64(h.b.Len() + len(values))}
+		p.write(h.b.Bytes())
+		p.write(values)
+		g.chunks = append(g.chunks, c)
+		g.size += c.size
+		p.data[i].Reset()
+	}
+	p.groups = append(p.groups, g)
+	p.total += p.rows
+	p.rows = 0
+}
+
+func pqType(kind int) int32 {
+	switch kind {
+	case CColInt:
+		return pqTypeInt64
+	case CColBool:
+		return pqTypeBoolean
+	}
+	return pqTypeByteArray
+}
+
+// Close writes the last row group and the footer.
+func (p *TParquetWriter) Close() error {
+	p.flush()
+	var m tcompact
+	m.i32(1, 1)
+	m.list(2, tcStruct, len(p.cols)+1)
+	m.begin(0)
+	m.binary(4, "schema")
+	m.i32(5, int32(len(p.cols)))
+	m.end()
+	for _, c := range p.cols {
+		m.begin(0)
+		m.i32(1, pqType(c.Kind))
+		m.i32(3, pqRequired)
+		m.binary(4, c.Name)
+		if c.Kind == CColString {
+			m.i32(6, pqConvertedUTF8)
+		}
+		m.end()
+	}
+	m.i64(3, p.total)
+	m.list(4, tcStruct, len(p.groups))
+	for _, g := range p.groups {
+		m.begin(0)
+		m.list(1, tcStruct, len(g.chunks))
+		for i, c := range g.chunks {
+			m.begin(0)
+			m.i64(2, c.offset)
+			m.begin(3)
+			m.i32(1, pqType(p.cols[i].Kind))
+			m.list(2, tcI32, 2)
+			m.zigzag(pqEncodingPlain)
+			m.zigzag(pqEncodingRLE)
+			m.list(3, tcBinary, 1)
+			m.str(p.cols[i].Name)
+			m.i32(4, pqCodecNone)
+			m.i64(5, g.rows)
+			m.i64(6, c.size)
+			m.i64(7, c.size)
+			m.i64(9, c.offset)
+			m.end()
+			m.end()
+		}
+		m.i64(2, g.size)
+		m.i64(3, g.rows)
+		m.end()
+	}
+	m.binary(6, "revizorro")
+	m.b.WriteByte(0)
+	var l [4]byte
+	binary.LittleEndian.PutUint32(l[:], uint32(m.b.Len()))
+	p.write(m.b.Bytes())
+	p.write(l[:])
+	p.write([]byte("PAR1"))
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
@@ -26,6 +26,8 @@ type TContent struct {
 	Url                         []string `xml:"url"`
 	IP                          []string `xml:"ip"`
 	Subnet                      []string `xml:"ipSubnet"`
+	IP6                         []string `xml:"ipv6"`
+	Subnet6                     []string `xml:"ipv6Subnet"`
 	Domain                      string   `xml:"domain"`
 	Id                          string   `xml:"id,attr"`
 	IncludeTime                 string   `xml:"includeTime,attr"`
@@ -70,10 +72,13 @@ func DumpUnzip(src, filename string) error {
 	return nil
 }
 
-func ParseDomains(src, dest string) error {
+func ParseDomains(src, dest, ipdest, addeddest, removeddest string, rpz *TRPZ, allow *TAllowList) error {
 	_dest := fmt.Sprintf("%s-temp", dest)
 	reg := TReg{}
 	domains := make(map[string]bool)
+	wildcards := make(map[string]bool)
+	ips := make(map[string]map[string]bool)
+	urgent := make(map[string]bool)
 	f, err := os.Open(src)
 	if err != nil {
 		return err
@@ -126,6 +131,7 @@ func ParseDomains(src, dest string) error {
 					fmt.Fprintf(os.Stderr, "IDNA parse error: %s\n", err.Error())
 					continue
 				}
+				wildcard := strings.HasPrefix(domain, "*.")
 				domain = strings.TrimPrefix(domain, "*.")
 				// domain syntax
 				if !isDomainName(domain) {
@@ -133,6 +139,21 @@ func ParseDomains(src, dest string) error {
 					continue
 				}
 				domains[domain] = true
+				if wildcard {
+					wildcards[domain] = true
+				}
+				if v.UrgencyType {
+					urgent[domain] = true
+				}
+				for _, ip := range append(append(append(v.IP, v.Subnet...), v.IP6...), v.Subnet6...) {
+					if ip = strings.TrimSpace(ip); ip == "" {
+						continue
+					}
+					if ips[domain] == nil {
+						ips[domain] = make(map[string]bool)
+					}
+					ips[domain][ip] = true
+				}
 			}
 		default:
 			//fmt.Printf("%v\n", _e)
@@ -153,9 +174,24 @@ func ParseDomains(src, dest string) error {
 			return err
 		}
 	}
+	added, removed, err := WriteDomainsDelta(dest, addeddest, removeddest, domains, urgent)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Domains added: %d, removed: %d\n", added, removed)
 	err = os.Rename(_dest, dest)
 	if err != nil {
 		return err
 	}
+	err = WriteRegisterIPs(ipdest, ips)
+	if err != nil {
+		return err
+	}
+	if rpz != nil {
+		err = WriteRPZ(rpz, reg, domains, wildcards, allow)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
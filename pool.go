@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+)
+
+// ResolvePool resolves the domains with a fixed number of workers fed
+// through a bounded queue. Results come in completion order, the channel
+// is closed when all the domains are done.
+func ResolvePool(domains []string, workers, queue uint, resolve func(string) *TDomainInfo) <-chan *TDomainInfo {
+	if workers == 0 {
+		workers = 1
+	}
+	jobs := make(chan string, queue)
+	messages := make(chan *TDomainInfo, queue)
+	var wg sync.WaitGroup
+	for i := uint(0); i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _domain := range jobs {
+				messages <- resolve(_domain)
+			}
+		}()
+	}
+	go func() {
+		for _, domain := range domains {
+			jobs <- domain
+		}
+		close(jobs)
+	}()
+	go func() {
+		wg.Wait()
+		close(messages)
+	}()
+	return messages
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startDNS serves A records of 192.0.2.x on a local UDP port, nx.test
+// is NXDOMAIN. A client subnet is echoed with a scope 8 bits shorter,
+// except for noecs.test, and gets 198.51.100.<source netmask> instead. The
+// returned function stops the server.
+func startDNS(tb testing.TB) (string, func()) {
+	tb.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		var ecs *dns.EDNS0_SUBNET
+		if o := r.IsEdns0(); o != nil {
+			for _, opt := range o.Option {
+				if e, ok := opt.(*dns.EDNS0_SUBNET); ok {
+					ecs = e
+				}
+			}
+		}
+		if ecs != nil && q.Name != "noecs.test." {
+			_ecs := *ecs
+			_ecs.SourceScope = ecs.SourceNetmask - 8
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &_ecs)
+		}
+		if q.Name == "nx.test." {
+			m.Rcode = dns.RcodeNameError
+		} else if q.Qtype == dns.TypeA && ecs != nil {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 300 IN A 198.51.100.%d", q.Name, ecs.SourceNetmask))
+			m.Answer = append(m.Answer, rr)
+		} else if q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 300 IN A 192.0.2.%d", q.Name, len(q.Name)))
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	return port, func() { srv.Shutdown() }
+}
+
+func testDomains(n int) []string {
+	domains := make([]string, n)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("d%d.test", i)
+	}
+	return domains
+}
+
+func TestResolvePool(t *testing.T) {
+	domains := testDomains(1000)
+	seen := make(map[string]int)
+	for dinfo := range ResolvePool(domains, 7, 3, func(domain string) *TDomainInfo {
+		return NewDomainInfo(domain)
+	}) {
+		seen[dinfo.Domain]++
+	}
+	if len(seen) != len(domains) {
+		t.Fatalf("%d domains resolved, want %d", len(seen), len(domains))
+	}
+	for domain, n := range seen {
+		if n != 1 {
+			t.Errorf("%s resolved %d times", domain, n)
+		}
+	}
+}
+
+// spawnPool is the resolution loop before ResolvePool: a goroutine per
+// domain, once maxpool are in flight the results are taken until fewer
+// than nextpool are left.
+func spawnPool(domains []string, maxpool, nextpool uint, resolve func(string) *TDomainInfo, put func(*TDomainInfo)) {
+	messages := make(chan *TDomainInfo, maxpool)
+	var cnt uint
+	for _, domain := range domains {
+		cnt++
+		go func(_domain string) {
+			messages <- resolve(_domain)
+		}(domain)
+		if cnt >= maxpool {
+			for cnt >= nextpool {
+				put(<-messages)
+				cnt--
+			}
+		}
+	}
+	for ; cnt > 0; cnt-- {
+		put(<-messages)
+	}
+}
+
+// BenchmarkResolvePool compares the pool with the loop it replaced, e.g.
+// go test -run X -bench ResolvePool -count 10 | benchstat -col /path -
+func BenchmarkResolvePool(b *testing.B) {
+	port, stop := startDNS(b)
+	defer stop()
+	p, err := DefaultProfile("127.0.0.1", port, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	p.Qtypes = []uint16{dns.TypeA}
+	cfg := &TResolveConfig{}
+	for _, c := range []struct {
+		workers, queue, qps uint
+	}{
+		{1, 1, 0},
+		{10, 8, 0},
+		{100, 80, 0},
+		{100, 80, 2000000000},
+	} {
+		limiter := NewLimiter(c.qps, c.qps, 0)
+		resolve := func(domain string) *TDomainInfo {
+			return resolveDomain(domain, p, nil, cfg, limiter, nil)
+		}
+		put := func(dinfo *TDomainInfo) {
+			if dinfo.Error {
+				b.Fatalf("%s: %s", dinfo.Domain, dinfo.Rcode)
+			}
+		}
+		if c.qps == 0 {
+			b.Run(fmt.Sprintf("path=spawn/workers=%d/qps=%d", c.workers, c.qps), func(b *testing.B) {
+				domains := testDomains(b.N)
+				b.ResetTimer()
+				spawnPool(domains, c.workers, c.queue, resolve, put)
+			})
+		}
+		b.Run(fmt.Sprintf("path=pool/workers=%d/qps=%d", c.workers, c.qps), func(b *testing.B) {
+			domains := testDomains(b.N)
+			b.ResetTimer()
+			for dinfo := range ResolvePool(domains, c.workers, c.queue, resolve) {
+				put(dinfo)
+			}
+		})
+	}
+}
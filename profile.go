@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TProfileConfig is a named resolution profile of the config file, its
+// keys are profile.<name>.<key>. A server is host or host:port, the port
+// is dnsport by default. Every domain is asked again once per client
+// subnet of ecs.
+type TProfileConfig struct {
+	Servers  []string `conf:"servers" required:"1"`
+	Qtypes   []string `conf:"qtypes" default:"A,AAAA" oneof:"A|AAAA"`
+	EDNS     bool     `conf:"edns" default:"1"`
+	DO       bool     `conf:"do" default:"1"`
+	UDPSize  uint     `conf:"udpsize" default:"4096" min:"512" max:"65535"`
+	Timeout  uint     `conf:"timeout" default:"30" min:"1"`
+	Attempts uint     `conf:"attempts" default:"1" min:"1"`
+	ECS      []string `conf:"ecs"`
+}
+
+// TProfile is how the domains are resolved: the servers asked, the query
+// types, the OPT record sent and the client subnets.
+type TProfile struct {
+	Name     string
+	Servers  []string
+	Qtypes   []uint16
+	EDNS     bool
+	DO       bool
+	UDPSize  uint16
+	Timeout  time.Duration
+	Attempts int
+	ECS      []netip.Prefix
+}
+
+var profileName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// profileReserved are the names of the other outputs in the workdir and
+// the results, a profile of that name would write over them.
+var profileReserved = map[string]bool{
+	"result": true, "urgent": true, "dnscache": true, "ipindex": true, "drift": true,
+	"compare": true, "current": true, "dump": true, "domains": true, "laststat": true,
+}
+
+func profilePrefix(name string) string {
+	return "profile." + name + "."
+}
+
+// nameserver returns host:port of a server, port is used unless the server
+// has one.
+func nameserver(server, port string) (string, error) {
+	if host, _port, err := net.SplitHostPort(server); err == nil {
+		if host == "" || _port == "" {
+			return "", fmt.Errorf("%s is not a valid server", server)
+		}
+		return server, nil
+	}
+	if net.ParseIP(server) != nil {
+		return net.JoinHostPort(server, port), nil
+	}
+	if !isDomainName(strings.TrimSuffix(server, ".")) {
+		return "", fmt.Errorf("%s is not a valid server", server)
+	}
+	return dns.Fqdn(server) + ":" + port, nil
+}
+
+// DefaultProfile asks the resolver of dnshost, it is the only profile when
+// none is configured.
+func DefaultProfile(host, port string, ecs []netip.Prefix) (*TProfile, error) {
+	p := &TProfile{
+		Qtypes:   []uint16{dns.TypeA, dns.TypeAAAA},
+		EDNS:     true,
+		DO:       true,
+		UDPSize:  dns.DefaultMsgSize,
+		Timeout:  TIMEOUT * time.Second,
+		Attempts: ATTEMPTS,
+		ECS:      ecs,
+	}
+	s, err := nameserver(host, port)
+	if err != nil {
+		return nil, err
+	}
+	p.Servers = []string{s}
+	return p, nil
+}
+
+func NewProfile(name string, pc *TProfileConfig, port uint) (*TProfile, error) {
+	p := &TProfile{
+		Name:     name,
+		EDNS:     pc.EDNS,
+		DO:       pc.DO,
+		UDPSize:  uint16(pc.UDPSize),
+		Timeout:  time.Duration(pc.Timeout) * time.Second,
+		Attempts: int(pc.Attempts),
+	}
+	for _, s := range pc.Servers {
+		_s, err := nameserver(s, fmt.Sprintf("%d", port))
+		if err != nil {
+			return nil, err
+		}
+		p.Servers = append(p.Servers, _s)
+	}
+	var err error
+	if p.ECS, err = ParsePrefixes(pc.ECS); err != nil {
+		return nil, err
+	}
+	for _, q := range pc.Qtypes {
+		p.Qtypes = append(p.Qtypes, dns.StringToType[q])
+	}
+	return p, nil
+}
+
+// Query tells if the profile asks for the query type.
+func (p *TProfile) Query(qtype uint16) bool {
+	for _, q := range p.Qtypes {
+		if q == qtype {
+			return true
+		}
+	}
+	return false
+}
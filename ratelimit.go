@@ -0,0 +1,116 @@
+package main
+
+import (
+	"golang.org/x/net/publicsuffix"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLimiter is a token bucket shared by all the queries of a pass plus an
+// optional cap of concurrently resolved domains per registered domain
+// (eTLD+1). A nil limiter does not limit.
+type TLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	zoneconc uint
+	zones    map[string]chan struct{}
+	waits    uint
+	waited   time.Duration
+	zwaits   uint
+	now      func() time.Time
+	sleep    func(time.Duration)
+}
+
+func NewLimiter(qps, burst, zoneconc uint) *TLimiter {
+	if qps == 0 && zoneconc == 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = 1
+	}
+	return &TLimiter{
+		rate:     float64(qps),
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+		zoneconc: zoneconc,
+		zones:    make(map[string]chan struct{}),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// Wait takes a token from the bucket, sleeping until one is available.
+func (l *TLimiter) Wait() {
+	if l == nil || l.rate == 0 {
+		return
+	}
+	l.mu.Lock()
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		l.waits++
+		l.waited += delay
+	}
+	l.mu.Unlock()
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// Zone returns the registered domain the politeness cap is counted by.
+func Zone(domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	if zone, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return zone
+	}
+	return domain
+}
+
+// AcquireZone blocks while the registered domain of the domain already has
+// zoneconc domains in flight, the returned function releases the slot.
+func (l *TLimiter) AcquireZone(domain string) func() {
+	if l == nil || l.zoneconc == 0 {
+		return func() {}
+	}
+	zone := Zone(domain)
+	l.mu.Lock()
+	sem, ok := l.zones[zone]
+	if !ok {
+		sem = make(chan struct{}, l.zoneconc)
+		l.zones[zone] = sem
+	}
+	l.mu.Unlock()
+	select {
+	case sem <- struct{}{}:
+	default:
+		l.mu.Lock()
+		l.zwaits++
+		l.mu.Unlock()
+		sem <- struct{}{}
+	}
+	return func() { <-sem }
+}
+
+// Stat adds the throttling counters to the pass statistics.
+func (l *TLimiter) Stat(stat *TResolveStat) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stat.Throttled = l.waits
+	stat.ThrottleWait = l.waited.Milliseconds()
+	stat.ZoneWaits = l.zwaits
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// tclock is a clock that only moves when slept on.
+type tclock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *tclock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *tclock) sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func TestLimiterQps(t *testing.T) {
+	clock := &tclock{t: time.Unix(1700000000, 0)}
+	l := NewLimiter(10, 5, 0)
+	l.now, l.sleep, l.last = clock.now, clock.sleep, clock.t
+	start := clock.t
+	var sent []time.Duration
+	for i := 0; i < 25; i++ {
+		l.Wait()
+		sent = append(sent, clock.now().Sub(start))
+	}
+	// The burst goes at once, then one query every 100ms.
+	for i, d := range sent {
+		want := time.Duration(0)
+		if i >= 5 {
+			want = time.Duration(i-4) * 100 * time.Millisecond
+		}
+		if d < want-time.Millisecond || d > want+time.Millisecond {
+			t.Errorf("query %d sent at %s, want %s", i, d, want)
+		}
+	}
+	// No second has more than qps plus the burst.
+	for i := range sent {
+		n := 0
+		for _, d := range sent[i:] {
+			if d-sent[i] < time.Second {
+				n++
+			}
+		}
+		if n > 15 {
+			t.Errorf("%d queries in the second from %s", n, sent[i])
+		}
+	}
+	stat := &TResolveStat{}
+	l.Stat(stat)
+	if stat.Throttled != 20 || stat.ThrottleWait < 1999 || stat.ThrottleWait > 2000 {
+		t.Errorf("throttled %d for %dms", stat.Throttled, stat.ThrottleWait)
+	}
+}
+
+func TestLimiterNil(t *testing.T) {
+	l := NewLimiter(0, 0, 0)
+	if l != nil {
+		t.Fatalf("limiter %+v without limits", l)
+	}
+	l.Wait()
+	l.AcquireZone("a.example")()
+	l.Stat(&TResolveStat{})
+}
+
+func TestZone(t *testing.T) {
+	for domain, want := range map[string]string{
+		"example.com":             "example.com",
+		"a.b.example.com.":        "example.com",
+		"www.example.co.uk":       "example.co.uk",
+		"user.github.io":          "user.github.io",
+		"com":                     "com",
+		"xn--80ak6aa92e.xn--p1ai": "xn--80ak6aa92e.xn--p1ai",
+	} {
+		if got := Zone(domain); got != want {
+			t.Errorf("zone of %s: %s, want %s", domain, got, want)
+		}
+	}
+}
+
+func TestLimiterZone(t *testing.T) {
+	l := NewLimiter(0, 0, 3)
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		releases = append(releases, l.AcquireZone("a.example.com"))
+	}
+	acquired := make(chan func())
+	go func() {
+		acquired <- l.AcquireZone("b.example.com")
+	}()
+	other := make(chan func())
+	go func() {
+		other <- l.AcquireZone("a.example.org")
+	}()
+	// Another zone is not held by the full one.
+	select {
+	case release := <-other:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("example.org waits for example.com")
+	}
+	select {
+	case <-acquired:
+		t.Fatal("a fourth domain of example.com got a slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	releases[0]()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the released slot wasn't taken")
+	}
+	for _, release := range releases[1:] {
+		release()
+	}
+	stat := &TResolveStat{}
+	l.Stat(stat)
+	if stat.ZoneWaits != 1 {
+		t.Errorf("zone waits %d, want 1", stat.ZoneWaits)
+	}
+
+	// Many domains of two zones never have more than 3 of a zone in
+	// flight.
+	var mu sync.Mutex
+	inflight := make(map[string]int)
+	max := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		domain := []string{"x.example.com", "y.example.net"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := l.AcquireZone(domain)
+			defer release()
+			zone := Zone(domain)
+			mu.Lock()
+			inflight[zone]++
+			if inflight[zone] > max[zone] {
+				max[zone] = inflight[zone]
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			inflight[zone]--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	for zone, n := range max {
+		if n > 3 {
+			t.Errorf("%d domains of %s in flight", n, zone)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// WriteRegisterIPs writes the <ip>, <ipSubnet>, <ipv6> and <ipv6Subnet>
+// entries the register lists for every domain, one "domain<TAB>ip,subnet,..." line per domain.
+func WriteRegisterIPs(filename string, ips map[string]map[string]bool) error {
+	return writeLines(filename, func(w *bufio.Writer) {
+		for domain, list := range ips {
+			_ips := make([]string, 0, len(list))
+			for ip := range list {
+				_ips = append(_ips, ip)
+			}
+			sort.Strings(_ips)
+			fmt.Fprintf(w, "%s\t%s\n", domain, strings.Join(_ips, ","))
+		}
+	})
+}
+
+// ReadRegisterIPs reads the file written by WriteRegisterIPs, a missing
+// file gives an empty result.
+func ReadRegisterIPs(filename string) (map[string][]netip.Prefix, error) {
+	result := make(map[string][]netip.Prefix)
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for _, ip := range strings.Split(parts[1], ",") {
+			p, err := ParsePrefixes([]string{ip})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Not valid register IP for %s: %s\n", parts[0], ip)
+				continue
+			}
+			result[parts[0]] = append(result[parts[0]], p...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func registerContains(prefixes []netip.Prefix, ip string) bool {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return prefixesContain(prefixes, a.Unmap())
+}
+
+type TDriftInfo struct {
+	Domain   string   `json:"d"`
+	Register []string `json:"reg"`
+	Live     []string `json:"live"`
+	Outside  []string `json:"out"`
+}
+
+// checkDrift compares the live addresses of a domain with the ones the
+// register lists for it, domains the register lists no addresses for or
+// without answers are not checked. Only the address families the register
+// lists for the domain are compared, allowlisted addresses are not.
+func checkDrift(dinfo *TDomainInfo, stat *TResolveStat) {
+	if len(dinfo.reg) == 0 || dinfo.Allowed || dinfo.Error {
+		return
+	}
+	var has4, has6 bool
+	for _, p := range dinfo.reg {
+		if p.Addr().Is4() {
+			has4 = true
+		} else {
+			has6 = true
+		}
+	}
+	allowed := make(map[string]bool)
+	for _, ip := range dinfo.AllowIp {
+		allowed[ip] = true
+	}
+	var live, out []string
+	for _, ip := range append(append([]string{}, dinfo.Ip4...), dinfo.Ip6...) {
+		a, err := netip.ParseAddr(ip)
+		if err != nil || allowed[ip] {
+			continue
+		}
+		if a = a.Unmap(); (a.Is4() && !has4) || (a.Is6() && !has6) {
+			continue
+		}
+		live = append(live, ip)
+		if !prefixesContain(dinfo.reg, a) {
+			out = append(out, ip)
+		}
+	}
+	if len(live) == 0 {
+		return
+	}
+	stat.Checked++
+	if len(out) == 0 {
+		return
+	}
+	dinfo.Drift = true
+	stat.Drift++
+	reg := make([]string, 0, len(dinfo.reg))
+	for _, p := range dinfo.reg {
+		reg = append(reg, p.String())
+	}
+	stat.drift = append(stat.drift, TDriftInfo{Domain: dinfo.Domain, Register: reg, Live: live, Outside: out})
+}
+
+// WriteDriftReport writes the domains whose live addresses left the
+// register listed ones.
+func WriteDriftReport(filename string, t int64, header *TDumpAnswer, list []TDriftInfo) error {
+	if list == nil {
+		list = make([]TDriftInfo, 0)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+	res, err := json.MarshalIndent(struct {
+		T    int64        `json:"t"`
+		H    *TDumpAnswer `json:"h"`
+		List []TDriftInfo `json:"list"`
+	}{t, header, list}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeLines(filename, func(w *bufio.Writer) {
+		w.Write(res)
+		w.WriteString("\n")
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckDrift(t *testing.T) {
+	allowfile := filepath.Join(t.TempDir(), "allow.txt")
+	if err := ioutil.WriteFile(allowfile, []byte("198.51.100.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	allow, err := ReadAllowList(allowfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, err := NewResultWriter(ioutil.Discard, CResultJson, _ADDRS_VERSION_, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name     string
+		reg      []string
+		ip4, ip6 []string
+		allowed  bool
+		checked  bool
+		out      []string
+	}{
+		{"in range", []string{"192.0.2.0/24"}, []string{"192.0.2.5"}, nil, false, true, nil},
+		{"out of range", []string{"192.0.2.0/24", "192.0.2.99"}, []string{"192.0.2.5", "203.0.113.1"}, nil, false, true, []string{"203.0.113.1"}},
+		{"not listed", nil, []string{"203.0.113.1"}, nil, false, false, nil},
+		{"dual stack", []string{"192.0.2.0/24"}, []string{"192.0.2.5"}, []string{"2001:db8::1"}, false, true, nil},
+		{"v6 only", []string{"192.0.2.0/24"}, nil, []string{"2001:db8::1"}, false, false, nil},
+		{"v6 listed", []string{"2001:db8::/32"}, []string{"203.0.113.1"}, []string{"2001:db8::1", "2001:db9::1"}, false, true, []string{"2001:db9::1"}},
+		{"allowlisted address", []string{"192.0.2.0/24"}, []string{"192.0.2.5", "198.51.100.7"}, nil, false, true, nil},
+		{"allowlisted domain", []string{"192.0.2.0/24"}, []string{"203.0.113.1"}, nil, true, false, nil},
+	} {
+		dinfo := NewDomainInfo("a.example")
+		dinfo.reg = testPrefixes(t, c.reg...)
+		dinfo.Ip4 = append(dinfo.Ip4, c.ip4...)
+		dinfo.Ip6 = append(dinfo.Ip6, c.ip6...)
+		dinfo.Allowed = c.allowed
+		stat := &TResolveStat{}
+		PutRes(dinfo, rw, stat, nil, allow, _ADDRS_VERSION_, make(map[string]TGeoInfo), make(map[string]TGeoInfo))
+		if (stat.Checked == 1) != c.checked || dinfo.Drift != (c.out != nil) || stat.Drift != uint(len(stat.drift)) {
+			t.Errorf("%s: checked %d, drift %v %d", c.name, stat.Checked, dinfo.Drift, stat.Drift)
+			continue
+		}
+		if c.out != nil && !reflect.DeepEqual(stat.drift[0].Outside, c.out) {
+			t.Errorf("%s: outside %v, want %v", c.name, stat.drift[0].Outside, c.out)
+		}
+	}
+}
+
+func TestRegisterIPs(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, CXMLDumpName)
+	dump := `<?xml version="1.0" encoding="UTF-8"?>
+<register updateTime="2023-11-14T22:13:20+00:00" formatVersion="2.4">
+<content id="1"><domain>a.example</domain><ip>192.0.2.1</ip><ipSubnet>198.51.100.0/24</ipSubnet><ipv6>2001:db8::1</ipv6><ipv6Subnet>2001:db8:1::/48</ipv6Subnet></content>
+<content id="2"><domain>b.example</domain><ipv6>2001:db8::2</ipv6></content>
+<content id="3"><domain>c.example</domain></content>
+</register>
+`
+	if err := ioutil.WriteFile(src, []byte(dump), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ipfile := filepath.Join(dir, "regips.txt")
+	err := ParseDomains(src, filepath.Join(dir, "domains.txt"), ipfile, filepath.Join(dir, "added.txt"), filepath.Join(dir, "removed.txt"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regips, err := ReadRegisterIPs(ipfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for domain, list := range regips {
+		for _, p := range list {
+			got[domain] = append(got[domain], p.String())
+		}
+	}
+	want := map[string][]string{
+		"a.example": {"192.0.2.1/32", "198.51.100.0/24", "2001:db8:1::/48", "2001:db8::1/128"},
+		"b.example": {"2001:db8::2/128"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("register ips %v, want %v", got, want)
+	}
+}
@@ -2,22 +2,20 @@ package main
 
 import (
 	"bufio"
-	"compress/gzip"
-	"encoding/json"
 	"fmt"
 	"github.com/miekg/dns"
-	"github.com/oschwald/maxminddb-golang"
 	"golang.org/x/net/idna"
-	"io"
-	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 )
 
 const _DEFAULT_VERSION_ = "1.0"
+const _ADDRS_VERSION_ = "2.0"
 
 func domainListRead(filename string) ([]string, int, error) {
 	var domains []string
@@ -63,43 +61,78 @@ func domainListRead(filename string) ([]string, int, error) {
 	return domains, c, nil
 }
 
-type TGeoRecord struct {
-	Country struct {
-		ISOCode string `maxminddb:"iso_code"`
-	} `maxminddb:"country"`
-} // Or any appropriate struct
-
 type TDomainInfo struct {
-	Domain  string       `json:"d"`
-	Dnssec  bool         `json:"ad,omitempty"`
-	Rrsig   bool         `json:"rs,omitempty"`
-	Cname   *TDomainInfo `json:"cn,omitempty"`
-	Ip4     []string     `json:"ip4,omitempty"`
-	Ip6     []string     `json:"ip6,omitempty"`
-	Rcode   string       `json:"rc,omitempty"`
-	Ip6only bool         `json:"ip6o,omitempty"`
-	Empty   bool         `json:"e,omitempty"`
-	Error   bool         `json:"err,omitempty"`
-	Country []string     `json:"c,omitempty"`
-	Cn      bool         `json:"-"`
+	Domain  string              `json:"d"`
+	Dnssec  bool                `json:"ad,omitempty"`
+	Rrsig   bool                `json:"rs,omitempty"`
+	Cname   *TDomainInfo        `json:"cn,omitempty"`
+	Ip4     []string            `json:"ip4,omitempty"`
+	Ip6     []string            `json:"ip6,omitempty"`
+	Rcode   string              `json:"rc,omitempty"`
+	Ip6only bool                `json:"ip6o,omitempty"`
+	Empty   bool                `json:"e,omitempty"`
+	Error   bool                `json:"err,omitempty"`
+	Country []string            `json:"c,omitempty"`
+	Allowed bool                `json:"al,omitempty"`
+	AllowIp []string            `json:"alip,omitempty"`
+	Geo     map[string]TGeoInfo `json:"g,omitempty"`
+	Addrs   []TAddrInfo         `json:"a,omitempty"`
+	Drift   bool                `json:"drift,omitempty"`
+	Profile string              `json:"p,omitempty"`
+	Verdict string              `json:"vd,omitempty"`
+	Subnets []TSubnetInfo       `json:"ecs,omitempty"`
+	Cn      bool                `json:"-"`
+	ttl     map[string]uint32
+	reg     []netip.Prefix
+	alt     []*TDomainInfo
+}
+
+// TAddrInfo is one resolved address of the 2.0 format.
+type TAddrInfo struct {
+	Ip string `json:"ip"`
+	TGeoInfo
+	Ttl      uint32 `json:"ttl,omitempty"`
+	Register bool   `json:"reg,omitempty"`
+	Allowed  bool   `json:"al,omitempty"`
 }
 
 type TResolveStat struct {
-	Domains  uint  `json:"domains"`
-	Dnssec   uint  `json:"dnssec"`
-	Rrsig    uint  `json:"rrsig"`
-	Cname    uint  `json:"cname"`
-	Fail     uint  `json:"servfail"`
-	Nx       uint  `json:"nxdomain"`
-	Ip4      uint  `json:"ip4"`
-	Ip6      uint  `json:"ip6"`
-	Uip4     uint  `json:"uniq_ip4"`
-	Uip6     uint  `json:"uniq_ip6"`
-	Ip6only  uint  `json:"ip6only"`
-	Empty    uint  `json:"empty"`
-	Errors   uint  `json:"errors"`
-	Duration int64 `json:"duration"`
-	Runet    uint  `json:"runet"`
+	Domains      uint         `json:"domains"`
+	Dnssec       uint         `json:"dnssec"`
+	Rrsig        uint         `json:"rrsig"`
+	Cname        uint         `json:"cname"`
+	Fail         uint         `json:"servfail"`
+	Nx           uint         `json:"nxdomain"`
+	Ip4          uint         `json:"ip4"`
+	Ip6          uint         `json:"ip6"`
+	Uip4         uint         `json:"uniq_ip4"`
+	Uip6         uint         `json:"uniq_ip6"`
+	Ip6only      uint         `json:"ip6only"`
+	Empty        uint         `json:"empty"`
+	Errors       uint         `json:"errors"`
+	Duration     int64        `json:"duration"`
+	Runet        uint         `json:"runet"`
+	Allowed      uint         `json:"allowed"`
+	AllowIp      uint         `json:"allowed_ip"`
+	Home         string       `json:"home"`
+	TopCountry   []TStatCount `json:"top_country,omitempty"`
+	TopAsn       []TStatCount `json:"top_asn,omitempty"`
+	Checked      uint         `json:"register_checked"`
+	Drift        uint         `json:"drift"`
+	Throttled    uint         `json:"throttled"`
+	ThrottleWait int64        `json:"throttle_wait_ms"`
+	ZoneWaits    uint         `json:"zone_waits"`
+	CacheHit     uint         `json:"cache_hit"`
+	CacheMiss    uint         `json:"cache_miss"`
+	Clean        uint         `json:"clean"`
+	Sinkholed    uint         `json:"sinkholed"`
+	NxInjected   uint         `json:"nxdomain_injected"`
+	Divergent    uint         `json:"divergent"`
+	countries    map[string]uint
+	asns         map[string]uint
+	orgs         map[string]string
+	drift        []TDriftInfo
+	ipindex      map[string][]string
 }
 
 func NewDomainInfo(domain string) *TDomainInfo {
@@ -108,16 +141,61 @@ func NewDomainInfo(domain string) *TDomainInfo {
 	di.Ip4 = make([]string, 0)
 	di.Ip6 = make([]string, 0)
 	di.Country = make([]string, 0)
+	di.ttl = make(map[string]uint32)
 	return &di
 }
 
-func PutRes(dinfo *TDomainInfo, w io.Writer, stat *TResolveStat, mmdb *maxminddb.Reader, Uip4, Uip6 map[string]string) {
-	var ip net.IP
-	var r TGeoRecord
+func PutRes(dinfo *TDomainInfo, rw *TResultWriter, stat *TResolveStat, geo *TGeo, allow *TAllowList, version string, Uip4, Uip6 map[string]TGeoInfo) {
 	var fl bool
-	var err error
-	flru := false
-	if dinfo.Error {
+	flhome := false
+	asns := make(map[uint]bool)
+	putip := func(i string, Uip map[string]TGeoInfo) {
+		addr := TAddrInfo{Ip: i, Ttl: dinfo.ttl[i], Register: registerContains(dinfo.reg, i)}
+		if allow.MatchIP(i) {
+			addr.Allowed = true
+			dinfo.Addrs = append(dinfo.Addrs, addr)
+			dinfo.AllowIp = append(dinfo.AllowIp, i)
+			return
+		}
+		info, ok := geo.Lookup(i)
+		addr.TGeoInfo = info
+		dinfo.Addrs = append(dinfo.Addrs, addr)
+		Uip[i] = info
+		stat.indexIP(i, dinfo.Domain)
+		if !ok {
+			return
+		}
+		if geo.Extended() {
+			if dinfo.Geo == nil {
+				dinfo.Geo = make(map[string]TGeoInfo)
+			}
+			dinfo.Geo[i] = info
+		}
+		if info.Asn != 0 && !asns[info.Asn] {
+			asns[info.Asn] = true
+			stat.countGeo(TGeoInfo{Asn: info.Asn, Org: info.Org})
+		}
+		if info.Country == "" {
+			return
+		}
+		fl = true
+		for _, _v := range dinfo.Country {
+			if _v == info.Country {
+				fl = false
+				break
+			}
+		}
+		if fl {
+			if info.Country == geo.Home {
+				flhome = true
+			}
+			dinfo.Country = append(dinfo.Country, info.Country)
+			stat.countGeo(TGeoInfo{Country: info.Country})
+		}
+	}
+	if dinfo.Allowed {
+		stat.Allowed++
+	} else if dinfo.Error {
 		stat.Errors++
 	} else {
 		if dinfo.Cn {
@@ -126,66 +204,24 @@ func PutRes(dinfo *TDomainInfo, w io.Writer, stat *TResolveStat, mmdb *maxminddb
 		if len(dinfo.Ip4) > 0 {
 			stat.Ip4++
 			for _, i := range dinfo.Ip4 {
-				if mmdb != nil {
-					ip = net.ParseIP(i)
-					err = mmdb.Lookup(ip, &r)
-					if err != nil {
-						Uip4[i] = " "
-					} else {
-						Uip4[i] = r.Country.ISOCode
-						fl = true
-						for _, _v := range dinfo.Country {
-							if _v == r.Country.ISOCode {
-								fl = false
-								break
-							}
-						}
-						if fl {
-							if r.Country.ISOCode == "RU" {
-								flru = true
-							}
-							dinfo.Country = append(dinfo.Country, r.Country.ISOCode)
-						}
-					}
-				} else {
-					Uip4[i] = " "
-				}
+				putip(i, Uip4)
 			}
 			stat.Uip4 = uint(len(Uip4))
 		}
 		if len(dinfo.Ip6) > 0 {
 			stat.Ip6++
 			for _, i := range dinfo.Ip6 {
-				if mmdb != nil {
-					ip = net.ParseIP(i)
-					err = mmdb.Lookup(ip, &r)
-					if err != nil {
-						Uip6[i] = " "
-					} else {
-						Uip6[i] = r.Country.ISOCode
-						fl = true
-						for _, _v := range dinfo.Country {
-							if _v == r.Country.ISOCode {
-								fl = false
-								break
-							}
-						}
-						if fl {
-							if r.Country.ISOCode == "RU" {
-								flru = true
-							}
-							dinfo.Country = append(dinfo.Country, r.Country.ISOCode)
-						}
-					}
-				} else {
-					Uip6[i] = " "
-				}
+				putip(i, Uip6)
 			}
 			stat.Uip6 = uint(len(Uip6))
 		}
-		if flru {
+		if flhome {
 			stat.Runet++
 		}
+		if len(dinfo.AllowIp) > 0 {
+			stat.AllowIp++
+		}
+		checkDrift(dinfo, stat)
 		if dinfo.Dnssec {
 			stat.Dnssec++
 		}
@@ -206,223 +242,345 @@ func PutRes(dinfo *TDomainInfo, w io.Writer, stat *TResolveStat, mmdb *maxminddb
 			}
 		}
 	}
-	res, err := json.MarshalIndent(dinfo, "\t", "\t")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Can't marshal json: %s", err.Error())
+	switch dinfo.Verdict {
+	case CVerdictClean:
+		stat.Clean++
+	case CVerdictSinkhole:
+		stat.Sinkholed++
+	case CVerdictNxInject:
+		stat.NxInjected++
+	case CVerdictDivergent:
+		stat.Divergent++
+	}
+	if version == _ADDRS_VERSION_ {
+		dinfo.Ip4, dinfo.Ip6, dinfo.Country, dinfo.Geo, dinfo.AllowIp = nil, nil, nil, nil, nil
+	} else {
+		dinfo.Addrs = nil
 	}
-	fmt.Fprint(w, string(res))
+	rw.Put(dinfo)
 }
 
-func ResolveList(dnshost, dnsport, domainsfile, mmdbfile, workdir, results string, maxpool, nextpool, forcecount uint, header *TDumpAnswer) error {
-	var domains []string
-	var Uip4 = make(map[string]string)
-	var Uip6 = make(map[string]string)
-	stat := &TResolveStat{}
-	_now := time.Now().Unix()
-	_time := fmt.Sprintf("%d", _now)
-	nameservers := []string{dnshost}
-	for j, nameserver := range nameservers {
-		if i := net.ParseIP(nameserver); i != nil {
-			nameservers[j] = net.JoinHostPort(nameserver, dnsport)
-		} else {
-			nameservers[j] = dns.Fqdn(nameserver) + ":" + dnsport
-		}
+// resolveDomain asks the servers of the profile, the cache is nil unless
+// it holds the answers of this profile.
+func resolveDomain(_domain string, p *TProfile, cache *TCache, cfg *TResolveConfig, limiter *TLimiter, regips map[string][]netip.Prefix) *TDomainInfo {
+	cnames := make(map[string]string)
+	dinfo := NewDomainInfo(_domain)
+	dinfo.Profile = p.Name
+	dinfo.reg = regips[_domain]
+	_ip4 := 0
+	_ip6 := 0
+	if cfg.Allow.MatchDomain(_domain) {
+		dinfo.Allowed = true
+		return dinfo
 	}
-	domains, _, err := domainListRead(domainsfile)
-	if err != nil {
-		return err
-	}
-	resultfile := fmt.Sprintf("%s/result.json", workdir)
-	tmpfile := fmt.Sprintf("%s/result.json.tmp", workdir)
-	if file, err := os.Create(tmpfile); err == nil {
-		defer file.Close()
-		geodb, err := maxminddb.Open(mmdbfile)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Internal error, can't open MaxMindDB: %s\n", err.Error())
-		} else {
-			defer geodb.Close()
+	query := func(qtype uint16) (*dns.Msg, error) {
+		if !cfg.Refresh {
+			if r, ok := cache.Get(_domain, qtype); ok {
+				return r, nil
+			}
 		}
-		w := bufio.NewWriter(file)
-		messages := make(chan *TDomainInfo, maxpool)
-		var cnt, allcnt uint
-		var wg sync.WaitGroup
-		_h, err := json.MarshalIndent(header, "\t", "\t")
-		if err != nil {
-			return err
+		release := limiter.AcquireZone(_domain)
+		defer release()
+		r, _, err := GetRR(_domain, p, qtype, netip.Prefix{}, limiter)
+		if err == nil {
+			cache.Put(_domain, qtype, r)
 		}
-		fmt.Fprintf(w, "{\n\t\"v\": \"%s\",\n\t\"t\": %s,\n\t\"h\": %s,\n\t\"list\": [\n", _DEFAULT_VERSION_, _time, _h)
-		for _, domain := range domains {
-			if forcecount > 0 && stat.Domains >= forcecount {
-				break
-			}
-			cnt++
-			stat.Domains++
-			wg.Add(1)
-			go func(_domain string) {
-				cnames := make(map[string]string)
-				dinfo := NewDomainInfo(_domain)
-				_ip4 := 0
-				_ip6 := 0
-				defer wg.Done()
-				if r, _, err := GetRR(_domain, nameservers, dns.TypeA); err == nil {
-					dinfo.Dnssec = r.AuthenticatedData
-					switch r.Rcode {
-					case dns.RcodeSuccess:
-						if len(r.Answer) > 0 {
-							if len(r.Answer) > 99 {
-								fmt.Fprintf(os.Stderr, "Internal error, for %s, Answer too big: %d\n", _domain, len(r.Answer))
-							}
-							for _, rr := range r.Answer {
-								if rr.Header().Rrtype == dns.TypeA {
-									dinfo.Ip4 = append(dinfo.Ip4, rr.(*dns.A).A.String())
-								} else if rr.Header().Rrtype == dns.TypeCNAME {
-									cnames[strings.TrimSuffix(rr.Header().Name, ".")] = strings.TrimSuffix(rr.(*dns.CNAME).Target, ".")
-								} else if rr.Header().Rrtype == dns.TypeRRSIG {
-									//fmt.Fprintf(os.Stderr, "Warning: RRSIG (%s): %#v", _domain, r.MsgHdr)
-									dinfo.Rrsig = true
-								} else {
-									fmt.Fprintf(os.Stderr, "Warning: unknown answer (%s): %s\n", _domain, rr.String())
-								}
-								_ip4++
-							}
-						}
-					default:
-						dinfo.Rcode = dns.RcodeToString[r.Rcode]
-					}
-				} else {
-					// dinfo.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
-					dinfo.Error = true
-					fmt.Fprintf(os.Stderr, "Type A. Internal error (%s): %s\n", _domain, err.Error())
-				}
-				if r, _, err := GetRR(_domain, nameservers, dns.TypeAAAA); err == nil {
-					dinfo.Dnssec = r.AuthenticatedData
-					switch r.Rcode {
-					case dns.RcodeSuccess:
-						if len(r.Answer) > 0 {
-							if len(r.Answer) > 99 {
-								fmt.Fprintf(os.Stderr, "Internal error, for %s, Answer too big: %d\n", _domain, len(r.Answer))
-							}
-							for _, rr := range r.Answer {
-								if rr.Header().Rrtype == dns.TypeAAAA {
-									dinfo.Ip6 = append(dinfo.Ip6, rr.(*dns.AAAA).AAAA.String())
-								} else if rr.Header().Rrtype == dns.TypeCNAME {
-									cnames[strings.TrimSuffix(rr.Header().Name, ".")] = strings.TrimSuffix(rr.(*dns.CNAME).Target, ".")
-								} else if rr.Header().Rrtype == dns.TypeRRSIG {
-									dinfo.Rrsig = true
-									// fmt.Fprintf(os.Stderr, "Warning: RRSIG (%s): %#v", _domain, r.MsgHdr)
-								} else {
-									fmt.Fprintf(os.Stderr, "Warning: unknown answer (%s): %s\n", _domain, rr.String())
-								}
-								_ip6++
-							}
-						}
-					default:
-						dinfo.Rcode = dns.RcodeToString[r.Rcode]
+		return r, err
+	}
+	if p.Query(dns.TypeA) {
+		if r, err := query(dns.TypeA); err == nil {
+			dinfo.Dnssec = r.AuthenticatedData
+			switch r.Rcode {
+			case dns.RcodeSuccess:
+				if len(r.Answer) > 0 {
+					if len(r.Answer) > 99 {
+						fmt.Fprintf(os.Stderr, "Internal error, for %s, Answer too big: %d\n", _domain, len(r.Answer))
 					}
-				} else {
-					// dinfo.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
-					dinfo.Error = true
-					fmt.Fprintf(os.Stderr, "Type AAAA. Internal error (%s): %s\n", _domain, err.Error())
-				}
-				if _ip4+_ip6 == 0 && !dinfo.Error && dinfo.Rcode == "" {
-					dinfo.Empty = true
-				}
-				if _ip6 > 0 && _ip4 == 0 {
-					dinfo.Ip6only = true
-				}
-				if len(cnames) > 0 {
-					dinfo.Cn = true
-					_cn := _domain
-					_cdi := dinfo
-					cname_i := 0
-					for {
-						if v, ok := cnames[_cn]; ok {
-							_ndi := NewDomainInfo(_cn)
-							_cn = v
-							_cdi.Cname = _ndi
-							_cdi = _ndi
+					for _, rr := range r.Answer {
+						if rr.Header().Rrtype == dns.TypeA {
+							dinfo.Ip4 = append(dinfo.Ip4, rr.(*dns.A).A.String())
+							dinfo.ttl[rr.(*dns.A).A.String()] = rr.Header().Ttl
+						} else if rr.Header().Rrtype == dns.TypeCNAME {
+							cnames[strings.TrimSuffix(rr.Header().Name, ".")] = strings.TrimSuffix(rr.(*dns.CNAME).Target, ".")
+						} else if rr.Header().Rrtype == dns.TypeRRSIG {
+							//fmt.Fprintf(os.Stderr, "Warning: RRSIG (%s): %#v", _domain, r.MsgHdr)
+							dinfo.Rrsig = true
 						} else {
-							_ndi := NewDomainInfo(_cn)
-							_cdi.Cname = _ndi
-							break
-						}
-						cname_i++
-						if cname_i == 10 {
-							fmt.Fprintf(os.Stderr, "Internal error for %s, CNAME ERROR: %#v\n", _domain, cnames)
-							break
+							fmt.Fprintf(os.Stderr, "Warning: unknown answer (%s): %s\n", _domain, rr.String())
 						}
+						_ip4++
 					}
 				}
-				//fmt.Println(string(res))
-				messages <- dinfo
-			}(domain)
-			if cnt >= maxpool {
-				for cnt >= nextpool {
-					select {
-					case res := <-messages:
-						cnt--
-						allcnt++
-						PutRes(res, w, stat, geodb, Uip4, Uip6)
-						if cnt >= 1 {
-							fmt.Fprint(w, ",\n")
+			default:
+				dinfo.Rcode = dns.RcodeToString[r.Rcode]
+			}
+		} else {
+			// dinfo.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
+			dinfo.Error = true
+			fmt.Fprintf(os.Stderr, "Type A. Internal error (%s): %s\n", _domain, err.Error())
+		}
+	}
+	if p.Query(dns.TypeAAAA) {
+		if r, err := query(dns.TypeAAAA); err == nil {
+			dinfo.Dnssec = r.AuthenticatedData
+			switch r.Rcode {
+			case dns.RcodeSuccess:
+				if len(r.Answer) > 0 {
+					if len(r.Answer) > 99 {
+						fmt.Fprintf(os.Stderr, "Internal error, for %s, Answer too big: %d\n", _domain, len(r.Answer))
+					}
+					for _, rr := range r.Answer {
+						if rr.Header().Rrtype == dns.TypeAAAA {
+							dinfo.Ip6 = append(dinfo.Ip6, rr.(*dns.AAAA).AAAA.String())
+							dinfo.ttl[rr.(*dns.AAAA).AAAA.String()] = rr.Header().Ttl
+						} else if rr.Header().Rrtype == dns.TypeCNAME {
+							cnames[strings.TrimSuffix(rr.Header().Name, ".")] = strings.TrimSuffix(rr.(*dns.CNAME).Target, ".")
+						} else if rr.Header().Rrtype == dns.TypeRRSIG {
+							dinfo.Rrsig = true
+							// fmt.Fprintf(os.Stderr, "Warning: RRSIG (%s): %#v", _domain, r.MsgHdr)
 						} else {
-							fmt.Fprint(w, "\n")
+							fmt.Fprintf(os.Stderr, "Warning: unknown answer (%s): %s\n", _domain, rr.String())
 						}
+						_ip6++
 					}
 				}
+			default:
+				dinfo.Rcode = dns.RcodeToString[r.Rcode]
+			}
+		} else {
+			// dinfo.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
+			dinfo.Error = true
+			fmt.Fprintf(os.Stderr, "Type AAAA. Internal error (%s): %s\n", _domain, err.Error())
+		}
+	}
+	if _ip4+_ip6 == 0 && !dinfo.Error && dinfo.Rcode == "" {
+		dinfo.Empty = true
+	}
+	if _ip6 > 0 && _ip4 == 0 {
+		dinfo.Ip6only = true
+	}
+	dinfo.Subnets = resolveSubnets(_domain, p, limiter)
+	if len(cnames) > 0 {
+		dinfo.Cn = true
+		_cn := _domain
+		_cdi := dinfo
+		cname_i := 0
+		for {
+			if v, ok := cnames[_cn]; ok {
+				_ndi := NewDomainInfo(_cn)
+				_cn = v
+				_cdi.Cname = _ndi
+				_cdi = _ndi
+			} else {
+				_ndi := NewDomainInfo(_cn)
+				_cdi.Cname = _ndi
+				break
+			}
+			cname_i++
+			if cname_i == 10 {
+				fmt.Fprintf(os.Stderr, "Internal error for %s, CNAME ERROR: %#v\n", _domain, cnames)
+				break
 			}
 		}
-		for cnt > 0 {
-			select {
-			case res := <-messages:
-				cnt--
-				allcnt++
-				PutRes(res, w, stat, geodb, Uip4, Uip6)
-				if cnt >= 1 {
-					fmt.Fprint(w, ",\n")
+	}
+	return dinfo
+}
+
+type TResolveConfig struct {
+	Name        string
+	DnsHost     string
+	DnsPort     string
+	DomainsFile string
+	RegIPsFile  string
+	Workdir     string
+	Results     string
+	Version     string
+	Output      string
+	Geo         TGeoConfig
+	Workers     uint
+	Queue       uint
+	Qps         uint
+	QpsBurst    uint
+	ZoneConc    uint
+	Sorted      bool
+	ForceCount  uint
+	Cache       *TCache
+	Refresh     bool
+	Store       *TStore
+	StoreKeep   uint
+	Allow       *TAllowList
+	IPExport    *TIPExport
+	Sink        *TSink
+	Alerts      *TAlerts
+	Profiles    []*TProfile
+	Stubs       *TStubs
+	ECS         []netip.Prefix
+}
+
+// tpass is the output of a profile in a pass. The first profile keeps the
+// names of a pass without profiles, the others add their name.
+type tpass struct {
+	name    string
+	suffix  string
+	seqfile string
+	out     *TResultOutput
+	rw      *TResultWriter
+	stat    *TResolveStat
+	uip4    map[string]TGeoInfo
+	uip6    map[string]TGeoInfo
+}
+
+// ResolveList resolves the domains through every profile, each one has its
+// result, the profiles are compared when there are several. The entries
+// get a verdict against the first, trusted, profile and the stub list.
+func ResolveList(cfg *TResolveConfig, header *TDumpAnswer) error {
+	var domains []string
+	_now := time.Now().Unix()
+	profiles := cfg.Profiles
+	if len(profiles) == 0 {
+		p, err := DefaultProfile(cfg.DnsHost, cfg.DnsPort, cfg.ECS)
+		if err != nil {
+			return err
+		}
+		profiles = []*TProfile{p}
+	}
+	domains, _, err := domainListRead(cfg.DomainsFile)
+	if err != nil {
+		return err
+	}
+	if cfg.ForceCount > 0 && uint(len(domains)) > cfg.ForceCount {
+		domains = domains[:cfg.ForceCount]
+	}
+	regips, err := ReadRegisterIPs(cfg.RegIPsFile)
+	if err != nil {
+		return err
+	}
+	passes := make([]*tpass, len(profiles))
+	for i, p := range profiles {
+		_p := &tpass{
+			name: cfg.Name,
+			stat: &TResolveStat{Home: cfg.Geo.Home, Domains: uint(len(domains))},
+			uip4: make(map[string]TGeoInfo),
+			uip6: make(map[string]TGeoInfo),
+		}
+		if i > 0 {
+			_p.name = strings.TrimPrefix(cfg.Name+"-"+p.Name, "-")
+		}
+		_name := "result"
+		if _p.name != "" {
+			_name, _p.suffix = _p.name, "-"+_p.name
+		}
+		resultfile := fmt.Sprintf("%s/%s.%s", cfg.Workdir, _name, ResultFormat(cfg.Output))
+		_p.seqfile = fmt.Sprintf("%s/%d%s.gz", cfg.Results, _now, _p.suffix)
+		if _p.out, err = CreateResultOutput(resultfile, _p.seqfile); err != nil {
+			return err
+		}
+		defer _p.out.Abort()
+		if _p.rw, err = NewResultWriter(_p.out.W, cfg.Output, cfg.Version, _now, header); err != nil {
+			return err
+		}
+		passes[i] = _p
+	}
+	geo := OpenGeo(cfg.Geo)
+	defer geo.Close()
+	limiter := NewLimiter(cfg.Qps, cfg.QpsBurst, cfg.ZoneConc)
+	store := cfg.Store
+	store.Begin(_now)
+	var cmp *TCompare
+	if len(profiles) > 1 {
+		cmp = NewCompare(profiles)
+	}
+	put := func(res *TDomainInfo) {
+		store.Record(res)
+		list := append([]*TDomainInfo{res}, res.alt...)
+		if cfg.Stubs != nil || len(list) > 1 {
+			for i, dinfo := range list {
+				if i == 0 {
+					dinfo.Verdict = Verdict(dinfo, profiles[0], nil, nil, cfg.Stubs)
 				} else {
-					fmt.Fprint(w, "\n")
+					dinfo.Verdict = Verdict(dinfo, profiles[i], res, profiles[0], cfg.Stubs)
 				}
 			}
 		}
-		wg.Wait()
-		close(messages)
-		stat.Duration = time.Now().Unix() - _now
-		_f, _ := json.MarshalIndent(stat, "\t", "\t")
-		fmt.Fprintf(w, "\t],\n\t\"stat\": %s\n}\n", _f)
-		w.Flush()
-		// fmt.Printf("C: %d\n\n", cnt)
+		cmp.Add(list)
+		for i, _p := range passes {
+			PutRes(list[i], _p.rw, _p.stat, geo, cfg.Allow, cfg.Version, _p.uip4, _p.uip6)
+		}
+	}
+	messages := ResolvePool(domains, cfg.Workers, cfg.Queue, func(_domain string) *TDomainInfo {
+		res := resolveDomain(_domain, profiles[0], cfg.Cache, cfg, limiter, regips)
+		for _, p := range profiles[1:] {
+			res.alt = append(res.alt, resolveDomain(_domain, p, nil, cfg, limiter, regips))
+		}
+		return res
+	})
+	if cfg.Sorted {
+		list := make([]*TDomainInfo, 0, len(domains))
+		for res := range messages {
+			list = append(list, res)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+		for _, res := range list {
+			put(res)
+		}
 	} else {
-		return err
+		for res := range messages {
+			put(res)
+		}
 	}
-	// fmt.Printf("Domains: %d\n", stat_cnt_domains)
-	os.Rename(tmpfile, resultfile)
-
-	seqfile := fmt.Sprintf("%s/%s.gz", results, _time)
-	tmpseqfile := seqfile + ".tmp"
-	if in, err := os.Open(resultfile); err == nil {
-		defer in.Close()
-		if out, err := os.Create(tmpseqfile); err == nil {
-			defer out.Close()
-			zw := gzip.NewWriter(out)
-			defer zw.Close()
-			if _, err = io.Copy(zw, in); err != nil {
-				return err
-			}
-			err = zw.Flush()
-			if err != nil {
-				return err
-			}
-			err = out.Sync()
-			if err != nil {
-				return err
+	var _before int64
+	if cfg.StoreKeep > 0 {
+		_before = _now - int64(cfg.StoreKeep)*86400
+	}
+	if err := store.Save(_before); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Can't store results, %d kept for the next pass: %s\n", store.Pending(), err.Error())
+	}
+	cfg.Cache.Stat(passes[0].stat)
+	if err := cfg.Cache.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Can't save DNS cache: %s\n", err.Error())
+	}
+	manifests := make([]*TManifest, len(passes))
+	for i, _p := range passes {
+		stat := _p.stat
+		stat.Duration = time.Now().Unix() - _now
+		limiter.Stat(stat)
+		stat.Top(cfg.Geo.TopN)
+		if err := WriteIPIndex(fmt.Sprintf("%s/ipindex%s.json", cfg.Workdir, _p.suffix), _now, stat.ipindex, _p.uip4, _p.uip6); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Can't write IP index: %s\n", err.Error())
+		}
+		if err := WriteDriftReport(fmt.Sprintf("%s/drift%s.json", cfg.Workdir, _p.suffix), _now, header, stat.drift); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Can't write drift report: %s\n", err.Error())
+		}
+		if err := _p.rw.Close(stat); err != nil {
+			return err
+		}
+		if i == 0 && cfg.IPExport != nil {
+			if err := ExportIPs(cfg.IPExport, _p.uip4, _p.uip6); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Can't export IPs: %s\n", err.Error())
 			}
-		} else {
+		}
+		m, err := _p.out.Commit(_now)
+		if err != nil {
 			return err
 		}
-	} else {
-		return err
+		m.Format = ResultFormat(cfg.Output)
+		if err = WriteManifest(_p.seqfile, m); err != nil {
+			return err
+		}
+		manifests[i] = m
+	}
+	if cmp != nil {
+		_suffix := ""
+		if cfg.Name != "" {
+			_suffix = "-" + cfg.Name
+		}
+		if err := cmp.Write(fmt.Sprintf("%s/compare%s.json", cfg.Workdir, _suffix), _now, header); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Can't write compare report: %s\n", err.Error())
+		}
+	}
+	for i, _p := range passes {
+		cfg.Alerts.Check(_p.name, _now, _p.stat)
+		cfg.Sink.Deliver(&TSinkStat{Name: _p.name, T: _now, File: filepath.Base(_p.seqfile), Header: header, Manifest: manifests[i], Stat: _p.stat}, _p.seqfile)
 	}
-	os.Rename(tmpseqfile, seqfile)
 	return nil
 }
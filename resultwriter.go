@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	CResultJson  string = "json"
+	CResultJsonl string = "jsonl"
+)
+
+// TResultWriter streams the result: the header, the list entries and the
+// stat. The document stays well formed whatever entries are put, an entry
+// that can't be marshalled is replaced by a bare error entry.
+//
+// In the jsonl format every record is a line of its own, flushed as soon
+// as it is written: {"v","t","h"} first, then the domains, {"stat"} last.
+type TResultWriter struct {
+	w     io.Writer
+	lines bool
+	n     uint
+	err   error
+}
+
+type TResultHeader struct {
+	Version string       `json:"v"`
+	T       int64        `json:"t"`
+	Header  *TDumpAnswer `json:"h"`
+}
+
+func NewResultWriter(w io.Writer, format, version string, t int64, header *TDumpAnswer) (*TResultWriter, error) {
+	rw := &TResultWriter{w: w, lines: format == CResultJsonl}
+	if rw.lines {
+		dat, err := json.Marshal(&TResultHeader{version, t, header})
+		if err != nil {
+			return nil, err
+		}
+		rw.line(dat)
+		return rw, rw.err
+	}
+	_h, err := json.MarshalIndent(header, "\t", "\t")
+	if err != nil {
+		return nil, err
+	}
+	_v, _ := json.Marshal(version)
+	rw.printf("{\n\t\"v\": %s,\n\t\"t\": %d,\n\t\"h\": %s,\n\t\"list\": [", _v, t, _h)
+	return rw, rw.err
+}
+
+// ResultFormat returns the format, json unless it is jsonl.
+func ResultFormat(format string) string {
+	if format == CResultJsonl {
+		return CResultJsonl
+	}
+	return CResultJson
+}
+
+// resultLines reports whether the first line of a result is the header
+// record of jsonl: a whole object without a list. A compact json result is
+// a single line too, with the list in it.
+func resultLines(first []byte) bool {
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(bytes.TrimSpace(first), &keys) != nil {
+		return false
+	}
+	_, ok := keys["list"]
+	return !ok
+}
+
+func (rw *TResultWriter) printf(format string, a ...interface{}) {
+	if rw.err != nil {
+		return
+	}
+	_, rw.err = fmt.Fprintf(rw.w, format, a...)
+}
+
+// line writes a jsonl record and flushes it, so the file can be tailed.
+func (rw *TResultWriter) line(dat []byte) {
+	rw.printf("%s\n", dat)
+	if f, ok := rw.w.(*bufio.Writer); ok && rw.err == nil {
+		rw.err = f.Flush()
+	}
+}
+
+// Put writes a list entry, the first write error is kept and returned by
+// Close.
+func (rw *TResultWriter) Put(dinfo *TDomainInfo) {
+	marshal := func(v interface{}) ([]byte, error) {
+		if rw.lines {
+			return json.Marshal(v)
+		}
+		return json.MarshalIndent(v, "\t\t", "\t")
+	}
+	res, err := marshal(dinfo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Can't marshal json of %s: %s\n", dinfo.Domain, err.Error())
+		res, _ = marshal(&TDomainInfo{Domain: dinfo.Domain, Error: true})
+	}
+	switch {
+	case rw.lines:
+		rw.line(res)
+	case rw.n > 0:
+		rw.printf(",\n\t\t%s", res)
+	default:
+		rw.printf("\n\t\t%s", res)
+	}
+	rw.n++
+}
+
+// Close ends the list and writes the stat.
+func (rw *TResultWriter) Close(stat *TResolveStat) error {
+	if rw.lines {
+		dat, err := json.Marshal(struct {
+			Stat *TResolveStat `json:"stat"`
+		}{stat})
+		if err != nil {
+			return err
+		}
+		rw.line(dat)
+		return rw.err
+	}
+	_f, err := json.MarshalIndent(stat, "\t", "\t")
+	if err != nil {
+		return err
+	}
+	if rw.n > 0 {
+		rw.printf("\n\t")
+	}
+	rw.printf("],\n\t\"stat\": %s\n}\n", _f)
+	return rw.err
+}
+
+// ReadResult reads a json or jsonl result entry by entry and returns its
+// stat. put gets the header (v, t, h) with every entry.
+func ReadResult(r io.Reader, put func(h *TResultHeader, dinfo *TDomainInfo) error) (*TResolveStat, error) {
+	br := bufio.NewReader(r)
+	first, err := br.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	h := &TResultHeader{}
+	var stat *TResolveStat
+	if resultLines(first) {
+		if err := json.Unmarshal(first, h); err != nil {
+			return nil, err
+		}
+		for no := 2; ; no++ {
+			line, err := br.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return stat, err
+			}
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				var rec struct {
+					TDomainInfo
+					Stat *TResolveStat `json:"stat"`
+				}
+				if err := json.Unmarshal(line, &rec); err != nil {
+					return stat, fmt.Errorf("line %d: %s", no, err.Error())
+				}
+				if rec.Stat != nil {
+					stat = rec.Stat
+				} else if err := put(h, &rec.TDomainInfo); err != nil {
+					return stat, err
+				}
+			}
+			if err == io.EOF {
+				return stat, nil
+			}
+		}
+	}
+	dec := json.NewDecoder(io.MultiReader(bytes.NewReader(first), br))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return stat, err
+		}
+		switch t {
+		case "v":
+			err = dec.Decode(&h.Version)
+		case "t":
+			err = dec.Decode(&h.T)
+		case "h":
+			err = dec.Decode(&h.Header)
+		case "stat":
+			err = dec.Decode(&stat)
+		case "list":
+			if _, err = dec.Token(); err != nil {
+				return stat, err
+			}
+			for dec.More() {
+				var dinfo TDomainInfo
+				if err = dec.Decode(&dinfo); err != nil {
+					return stat, err
+				}
+				if err = put(h, &dinfo); err != nil {
+					return stat, err
+				}
+			}
+			_, err = dec.Token()
+		default:
+			var v interface{}
+			err = dec.Decode(&v)
+		}
+		if err != nil {
+			return stat, err
+		}
+	}
+	return stat, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func testDump() *TDumpAnswer {
+	return &TDumpAnswer{CRC: "0123abcd", Id: "5f3e", Size: 1024, UpdateTime: 1700000000}
+}
+
+// testResult writes a result of n domains, bad adds an entry that can't
+// be marshalled.
+func testResult(t *testing.T, format, version string, n int, bad bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	rw, err := NewResultWriter(&buf, format, version, 1700000000, testDump())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := &TResolveStat{Home: "RU"}
+	for i := 0; i < n; i++ {
+		dinfo := NewDomainInfo(fmt.Sprintf("d%d.example", i))
+		dinfo.Ip4 = []string{fmt.Sprintf("192.0.2.%d", i)}
+		dinfo.Rcode = "NOERROR"
+		if version == _ADDRS_VERSION_ {
+			dinfo.Addrs = []TAddrInfo{{Ip: dinfo.Ip4[0], Ttl: 300}}
+			dinfo.Ip4, dinfo.Country = nil, nil
+		}
+		rw.Put(dinfo)
+		stat.Domains++
+	}
+	if bad {
+		dinfo := NewDomainInfo("loop.example")
+		dinfo.Cname = dinfo
+		rw.Put(dinfo)
+		stat.Domains++
+	}
+	if err := rw.Close(stat); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResultWriterSchema(t *testing.T) {
+	schema, err := ParseSchema(ResultSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{CResultJson, CResultJsonl} {
+		for _, version := range []string{_DEFAULT_VERSION_, _ADDRS_VERSION_} {
+			for _, c := range []struct {
+				n   int
+				bad bool
+			}{{0, false}, {1, false}, {25, false}, {0, true}, {3, true}} {
+				name := fmt.Sprintf("%s/%s/n=%d/bad=%v", format, version, c.n, c.bad)
+				dat := testResult(t, format, version, c.n, c.bad)
+				want := c.n
+				if c.bad {
+					want++
+				}
+				n, err := ValidateResult(bytes.NewReader(dat), schema)
+				if err != nil {
+					t.Errorf("%s: %s\n%s", name, err.Error(), dat)
+					continue
+				}
+				if n != want {
+					t.Errorf("%s: %d entries validated, want %d", name, n, want)
+				}
+			}
+		}
+	}
+}
+
+func TestResultWriterRead(t *testing.T) {
+	for _, format := range []string{CResultJson, CResultJsonl} {
+		var domains []string
+		var errs int
+		stat, err := ReadResult(bytes.NewReader(testResult(t, format, _DEFAULT_VERSION_, 3, true)), func(h *TResultHeader, dinfo *TDomainInfo) error {
+			if h.Version != _DEFAULT_VERSION_ || h.T != 1700000000 || h.Header == nil || h.Header.Id != "5f3e" {
+				t.Errorf("%s: header %+v", format, h)
+			}
+			domains = append(domains, dinfo.Domain)
+			if dinfo.Error {
+				errs++
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", format, err.Error())
+		}
+		if len(domains) != 4 || domains[3] != "loop.example" || errs != 1 {
+			t.Errorf("%s: domains %v, %d errors", format, domains, errs)
+		}
+		if stat == nil || stat.Domains != 4 || stat.Home != "RU" {
+			t.Errorf("%s: stat %+v", format, stat)
+		}
+	}
+}
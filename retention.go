@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TRetention limits the snapshots kept in the results directory, a zero
+// value disables the limit. Count is per kind of snapshot, SizeMB is the
+// total of all kinds. Snapshots older than ThinHours are thinned to one
+// per hour, older than ThinDays to one per day.
+type TRetention struct {
+	Count     uint
+	Days      uint
+	SizeMB    uint
+	ThinHours uint
+	ThinDays  uint
+}
+
+type TSnapshot struct {
+	Name string
+	T    int64
+	Kind string
+	Size int64
+}
+
+func (r *TRetention) Enabled() bool {
+	return r != nil && (r.Count > 0 || r.Days > 0 || r.SizeMB > 0 || r.ThinHours > 0 || r.ThinDays > 0)
+}
+
+// ListSnapshots returns the <ts>[-kind].gz snapshots of the directory,
+// newest first.
+func ListSnapshots(dir string) ([]TSnapshot, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []TSnapshot
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, ".gz") {
+			continue
+		}
+		base := strings.TrimSuffix(name, ".gz")
+		kind := ""
+		if i := strings.IndexByte(base, '-'); i >= 0 {
+			base, kind = base[:i], base[i+1:]
+		}
+		t, err := strconv.ParseInt(base, 10, 64)
+		if err != nil {
+			continue
+		}
+		list = append(list, TSnapshot{Name: name, T: t, Kind: kind, Size: f.Size()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].T > list[j].T })
+	return list, nil
+}
+
+// expired returns the reason the snapshot has to go, the newest snapshot
+// of every kind is always kept (and counts against the size limit).
+func (r *TRetention) expired(list []TSnapshot, now int64) map[string]string {
+	del := make(map[string]string)
+	newest := make(map[string]bool)
+	buckets := make(map[string]bool)
+	kept := make(map[string]uint)
+	var size int64
+	for _, s := range list {
+		if !newest[s.Kind] {
+			newest[s.Kind] = true
+			kept[s.Kind]++
+			size += s.Size
+		}
+	}
+	newest = make(map[string]bool)
+	for _, s := range list {
+		if !newest[s.Kind] {
+			newest[s.Kind] = true
+			continue
+		}
+		age := now - s.T
+		bucket := ""
+		if r.ThinDays > 0 && age > int64(r.ThinDays)*86400 {
+			bucket = time.Unix(s.T, 0).Format("d20060102")
+		} else if r.ThinHours > 0 && age > int64(r.ThinHours)*3600 {
+			bucket = time.Unix(s.T, 0).Format("h2006010215")
+		}
+		switch {
+		case r.Days > 0 && age > int64(r.Days)*86400:
+			del[s.Name] = "age"
+		case bucket != "" && buckets[s.Kind+bucket]:
+			del[s.Name] = "thinning"
+		case r.Count > 0 && kept[s.Kind] >= r.Count:
+			del[s.Name] = "count"
+		case r.SizeMB > 0 && size+s.Size > int64(r.SizeMB)*1024*1024:
+			del[s.Name] = "size"
+		default:
+			kept[s.Kind]++
+			size += s.Size
+		}
+		if bucket != "" {
+			buckets[s.Kind+bucket] = true
+		}
+	}
+	return del
+}
+
+// ApplyRetention removes the snapshots of the results directory the policy
+// does not keep, every removal is logged.
+func ApplyRetention(dir string, r *TRetention) error {
+	if !r.Enabled() {
+		return nil
+	}
+	list, err := ListSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	del := r.expired(list, time.Now().Unix())
+	for _, s := range list {
+		reason, ok := del[s.Name]
+		if !ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, s.Name)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Retention can't remove %s: %s\n", s.Name, err.Error())
+			continue
+		}
+		fmt.Printf("Retention: removed %s (%s)\n", s.Name, reason)
+		if err := os.Remove(ManifestFile(filepath.Join(dir, s.Name))); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Error: Retention can't remove manifest of %s: %s\n", s.Name, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const CTestMB = 1024 * 1024
+
+func testSnapshots(now int64, kinds ...string) []TSnapshot {
+	var list []TSnapshot
+	for i := int64(0); i < 4; i++ {
+		for _, kind := range kinds {
+			name := fmt.Sprintf("%d.gz", now-i*3600)
+			if kind != "" {
+				name = fmt.Sprintf("%d-%s.gz", now-i*3600, kind)
+			}
+			list = append(list, TSnapshot{Name: name, T: now - i*3600, Kind: kind, Size: CTestMB})
+		}
+	}
+	return list
+}
+
+func TestRetentionSize(t *testing.T) {
+	now := int64(1700000000)
+	list := testSnapshots(now, "", "stat")
+	// 8 MB in two kinds, 5 MB fit: the newest of both kinds and the next
+	// 3 newest.
+	del := (&TRetention{SizeMB: 5}).expired(list, now)
+	want := map[string]string{
+		fmt.Sprintf("%d-stat.gz", now-2*3600): "size",
+		fmt.Sprintf("%d.gz", now-3*3600):      "size",
+		fmt.Sprintf("%d-stat.gz", now-3*3600): "size",
+	}
+	if !reflect.DeepEqual(del, want) {
+		t.Errorf("got %v, want %v", del, want)
+	}
+	// The newest of every kind stays even over the limit.
+	del = (&TRetention{SizeMB: 1}).expired(list, now)
+	if len(del) != 6 {
+		t.Errorf("%d removed, want 6: %v", len(del), del)
+	}
+	for _, name := range []string{fmt.Sprintf("%d.gz", now), fmt.Sprintf("%d-stat.gz", now)} {
+		if _, ok := del[name]; ok {
+			t.Errorf("newest %s removed", name)
+		}
+	}
+}
+
+func TestRetentionCount(t *testing.T) {
+	now := int64(1700000000)
+	del := (&TRetention{Count: 2}).expired(testSnapshots(now, "", "stat"), now)
+	want := map[string]string{
+		fmt.Sprintf("%d.gz", now-2*3600):      "count",
+		fmt.Sprintf("%d-stat.gz", now-2*3600): "count",
+		fmt.Sprintf("%d.gz", now-3*3600):      "count",
+		fmt.Sprintf("%d-stat.gz", now-3*3600): "count",
+	}
+	if !reflect.DeepEqual(del, want) {
+		t.Errorf("got %v, want %v", del, want)
+	}
+}
+
+func TestRetentionAge(t *testing.T) {
+	now := int64(1700000000)
+	list := []TSnapshot{
+		{Name: "old.gz", T: now - 10*86400},
+		{Name: "older.gz", T: now - 20*86400},
+	}
+	// Even an expired newest snapshot is kept.
+	del := (&TRetention{Days: 5}).expired(list, now)
+	if !reflect.DeepEqual(del, map[string]string{"older.gz": "age"}) {
+		t.Errorf("got %v", del)
+	}
+}
+
+func TestRetentionThin(t *testing.T) {
+	now := time.Date(2023, 11, 14, 0, 0, 0, 0, time.Local).Unix()
+	var list []TSnapshot
+	for i := int64(0); i < 48; i++ {
+		list = append(list, TSnapshot{Name: fmt.Sprintf("%d.gz", now-i*1800), T: now - i*1800})
+	}
+	del := (&TRetention{ThinHours: 6}).expired(list, now)
+	// Past 6 hours (from 17:30) every hour keeps one of its two
+	// snapshots.
+	n := 0
+	for _, reason := range del {
+		if reason != "thinning" {
+			t.Errorf("reason %s", reason)
+		}
+		n++
+	}
+	if n != 17 {
+		t.Errorf("%d thinned, want 17", n)
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := int64(1700000000)
+	for _, s := range testSnapshots(now, "", "stat") {
+		if err := ioutil.WriteFile(filepath.Join(dir, s.Name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "result.json"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyRetention(dir, &TRetention{Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	want := []string{fmt.Sprintf("%d-stat.gz", now), fmt.Sprintf("%d.gz", now), "result.json"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("left %v, want %v", names, want)
+	}
+	if err := ApplyRetention(filepath.Join(dir, "missing"), &TRetention{Count: 1}); !os.IsNotExist(err) {
+		t.Errorf("missing dir: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CRPZActionNxdomain string = "nxdomain"
+	CRPZActionNodata   string = "nodata"
+	CRPZActionCname    string = "cname"
+)
+
+type TRPZ struct {
+	Filename string
+	Origin   string
+	Action   string
+	Garden   string
+	TTL      uint
+	Serial   uint32
+}
+
+// RPZSerial derives the SOA serial from the dump metainfo: the update time
+// if the API returned one, 0 otherwise and WriteRPZ picks one.
+func RPZSerial(dump *TDumpAnswer) uint32 {
+	if dump == nil {
+		return 0
+	}
+	if dump.UpdateTime > 0 {
+		ut := int64(dump.UpdateTime)
+		// milliseconds
+		if ut > 1e11 {
+			ut /= 1000
+		}
+		return uint32(ut)
+	}
+	return 0
+}
+
+// rpzLastSerial returns the SOA serial of the zone written before, 0 if
+// there is none.
+func rpzLastSerial(filename string) uint32 {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && fields[1] == "SOA" {
+			serial, _ := strconv.ParseUint(fields[4], 10, 32)
+			return uint32(serial)
+		}
+	}
+	return 0
+}
+
+func rpzRegisterSerial(reg TReg) uint32 {
+	for _, _t := range []string{reg.UpdateTimeUrgently, reg.UpdateTime} {
+		if _t == "" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, _t); err == nil {
+			return uint32(t.Unix())
+		}
+	}
+	return 0
+}
+
+func rpzTarget(rpz *TRPZ) (string, error) {
+	switch rpz.Action {
+	case CRPZActionNxdomain, "":
+		return ".", nil
+	case CRPZActionNodata:
+		return "*.", nil
+	case CRPZActionCname:
+		if rpz.Garden == "" {
+			return "", fmt.Errorf("RPZ action %s without walled garden", rpz.Action)
+		}
+		return dns.Fqdn(rpz.Garden), nil
+	}
+	return "", fmt.Errorf("Unknown RPZ action: %s", rpz.Action)
+}
+
+// WriteRPZ writes the response policy zone for the domains. Domains
+// registered as *.domain get a wildcard entry next to the apex one,
+// allowlisted ones are left out.
+func WriteRPZ(rpz *TRPZ, reg TReg, domains, wildcards map[string]bool, allow *TAllowList) error {
+	target, err := rpzTarget(rpz)
+	if err != nil {
+		return err
+	}
+	serial := rpz.Serial
+	if serial == 0 {
+		serial = rpzRegisterSerial(reg)
+	}
+	if serial == 0 {
+		serial = uint32(time.Now().Unix())
+	}
+	// Secondaries ignore a zone whose serial didn't go up.
+	if last := rpzLastSerial(rpz.Filename); serial <= last {
+		serial = last + 1
+	}
+	origin := dns.Fqdn(rpz.Origin)
+	list := make([]string, 0, len(domains))
+	for k := range domains {
+		if allow.MatchDomain(k) {
+			continue
+		}
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	tmpfile := fmt.Sprintf("%s-temp", rpz.Filename)
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "$ORIGIN %s\n$TTL %d\n", origin, rpz.TTL)
+	fmt.Fprintf(w, "@\tSOA\tlocalhost. root.localhost. %d 3600 600 86400 %d\n", serial, rpz.TTL)
+	fmt.Fprint(w, "@\tNS\tlocalhost.\n")
+	for _, d := range list {
+		fmt.Fprintf(w, "%s\tCNAME\t%s\n", d, target)
+		if wildcards[d] {
+			fmt.Fprintf(w, "*.%s\tCNAME\t%s\n", d, target)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, rpz.Filename)
+}
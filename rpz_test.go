@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRPZSerial(t *testing.T) {
+	for _, c := range []struct {
+		dump *TDumpAnswer
+		want uint32
+	}{
+		{nil, 0},
+		{&TDumpAnswer{Id: "5f3e"}, 0},
+		{&TDumpAnswer{Id: "5f3e", UpdateTime: 1700000000}, 1700000000},
+		{&TDumpAnswer{Id: "5f3e", UpdateTime: 1700000000123}, 1700000000},
+	} {
+		if got := RPZSerial(c.dump); got != c.want {
+			t.Errorf("%+v: serial %d, want %d", c.dump, got, c.want)
+		}
+	}
+}
+
+func TestRPZSerialMonotonic(t *testing.T) {
+	rpz := &TRPZ{Filename: filepath.Join(t.TempDir(), "rpz.zone"), Origin: "rpz.local", TTL: 60}
+	domains := map[string]bool{"a.example": true}
+	write := func(serial uint32, reg TReg) uint32 {
+		t.Helper()
+		rpz.Serial = serial
+		if err := WriteRPZ(rpz, reg, domains, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		return rpzLastSerial(rpz.Filename)
+	}
+	if got := write(1700000000, TReg{}); got != 1700000000 {
+		t.Fatalf("serial %d, want the update time", got)
+	}
+	// An older or equal source serial still goes up.
+	if got := write(1600000000, TReg{}); got != 1700000001 {
+		t.Errorf("older update time: serial %d", got)
+	}
+	if got := write(1700000001, TReg{}); got != 1700000002 {
+		t.Errorf("same update time: serial %d", got)
+	}
+	if got := write(0, TReg{UpdateTime: "2023-11-14T22:13:30+00:00"}); got != 1700000010 {
+		t.Errorf("register update time: serial %d", got)
+	}
+	// Without a time in the dump or the register the clock is used.
+	now := uint32(time.Now().Unix())
+	if got := write(0, TReg{}); got < now {
+		t.Errorf("no update time: serial %d before %d", got, now)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ResultSchema is the JSON Schema of result.json, it is published as
+// result.schema.json.
+//
+//go:embed result.schema.json
+var ResultSchema []byte
+
+// TSchema is the subset of JSON Schema the result schema uses.
+type TSchema struct {
+	Ref                  string              `json:"$ref"`
+	Type                 json.RawMessage     `json:"type"`
+	Enum                 []interface{}       `json:"enum"`
+	Minimum              *float64            `json:"minimum"`
+	Properties           map[string]*TSchema `json:"properties"`
+	Required             []string            `json:"required"`
+	AdditionalProperties json.RawMessage     `json:"additionalProperties"`
+	Items                *TSchema            `json:"items"`
+	Definitions          map[string]*TSchema `json:"definitions"`
+	types                []string
+	additional           *TSchema
+	noadditional         bool
+}
+
+// ParseSchema reads a schema and resolves the fields the validator needs.
+func ParseSchema(dat []byte) (*TSchema, error) {
+	var s TSchema
+	if err := json.Unmarshal(dat, &s); err != nil {
+		return nil, err
+	}
+	if err := s.prepare(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *TSchema) prepare(root *TSchema) error {
+	if s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/definitions/")
+		if root.Definitions[name] == nil {
+			return fmt.Errorf("Schema reference %s not found", s.Ref)
+		}
+		return nil
+	}
+	if len(s.Type) > 0 {
+		if json.Unmarshal(s.Type, &s.types) != nil {
+			var t string
+			if err := json.Unmarshal(s.Type, &t); err != nil {
+				return err
+			}
+			s.types = []string{t}
+		}
+	}
+	if len(s.AdditionalProperties) > 0 {
+		var b bool
+		if json.Unmarshal(s.AdditionalProperties, &b) == nil {
+			s.noadditional = !b
+		} else if err := json.Unmarshal(s.AdditionalProperties, &s.additional); err != nil {
+			return err
+		}
+	}
+	children := []*TSchema{s.Items, s.additional}
+	for _, p := range s.Properties {
+		children = append(children, p)
+	}
+	for _, d := range s.Definitions {
+		children = append(children, d)
+	}
+	for _, c := range children {
+		if c == nil {
+			continue
+		}
+		if err := c.prepare(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *TSchema) resolve(root *TSchema) *TSchema {
+	for s.Ref != "" {
+		s = root.Definitions[strings.TrimPrefix(s.Ref, "#/definitions/")]
+	}
+	return s
+}
+
+func schemaType(v interface{}) string {
+	switch _v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if strings.ContainsAny(_v.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// Validate checks a value decoded with UseNumber against the schema.
+func (s *TSchema) Validate(root *TSchema, v interface{}, path string) error {
+	s = s.resolve(root)
+	t := schemaType(v)
+	if len(s.types) > 0 {
+		ok := false
+		for _, _t := range s.types {
+			if _t == t || (_t == "number" && t == "integer") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: %s is not %s", path, t, strings.Join(s.types, " or "))
+		}
+	}
+	if len(s.Enum) > 0 {
+		ok := false
+		for _, e := range s.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: %v is not allowed", path, v)
+		}
+	}
+	switch _v := v.(type) {
+	case json.Number:
+		if f, err := _v.Float64(); err == nil && s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s: %s is less than %v", path, _v, *s.Minimum)
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range _v {
+				if err := s.Items.Validate(root, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, k := range s.Required {
+			if _, ok := _v[k]; !ok {
+				return fmt.Errorf("%s: %s is required", path, k)
+			}
+		}
+		for k, item := range _v {
+			if err := s.validateProperty(root, k, item, path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *TSchema) validateProperty(root *TSchema, k string, v interface{}, path string) error {
+	p := s.Properties[k]
+	if p == nil {
+		if s.noadditional {
+			return fmt.Errorf("%s: %s is not allowed", path, k)
+		}
+		if p = s.additional; p == nil {
+			return nil
+		}
+	}
+	return p.Validate(root, v, path+"."+k)
+}
+
+// ValidateResult checks a result against the schema, the format (json or
+// jsonl) is told by the first line. The list is read entry by entry, so the
+// whole result is never held in memory. It returns the number of list
+// entries.
+func ValidateResult(r io.Reader, s *TSchema) (int, error) {
+	br := bufio.NewReader(r)
+	first, err := br.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if resultLines(first) {
+		return validateLines(first, br, s)
+	}
+	return validateDocument(io.MultiReader(bytes.NewReader(first), br), s)
+}
+
+// validateLines checks a jsonl result: the header record, the domains and
+// the stat record, which must be the last one.
+func validateLines(first []byte, br *bufio.Reader, s *TSchema) (int, error) {
+	n := 0
+	decode := func(line []byte, no int) (map[string]interface{}, error) {
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		var v map[string]interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("line %d: %s", no, err.Error())
+		}
+		if dec.More() {
+			return nil, fmt.Errorf("line %d: more than one record", no)
+		}
+		return v, nil
+	}
+	h, err := decode(first, 1)
+	if err != nil {
+		return n, err
+	}
+	for _, k := range []string{"v", "t", "h"} {
+		if _, ok := h[k]; !ok {
+			return n, fmt.Errorf("line 1: %s is required", k)
+		}
+	}
+	for k, v := range h {
+		if k != "v" && k != "t" && k != "h" {
+			return n, fmt.Errorf("line 1: %s is not allowed", k)
+		}
+		if err := s.validateProperty(s, k, v, "$"); err != nil {
+			return n, err
+		}
+	}
+	items := s.Properties["list"].resolve(s).Items
+	stat := false
+	for no := 2; ; no++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			if stat {
+				return n, fmt.Errorf("line %d: record after the stat", no)
+			}
+			v, err := decode(line, no)
+			if err != nil {
+				return n, err
+			}
+			if _stat, ok := v["stat"]; ok {
+				if len(v) > 1 {
+					return n, fmt.Errorf("line %d: stat record with other keys", no)
+				}
+				if err := s.validateProperty(s, "stat", _stat, "$"); err != nil {
+					return n, err
+				}
+				stat = true
+			} else {
+				if err := items.Validate(s, v, fmt.Sprintf("$.list[%d]", n)); err != nil {
+					return n, err
+				}
+				n++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if !stat {
+		return n, fmt.Errorf("The stat record is missing")
+	}
+	return n, nil
+}
+
+func validateDocument(r io.Reader, s *TSchema) (int, error) {
+	n := 0
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	delim := func(want json.Delim) error {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := t.(json.Delim); !ok || d != want {
+			return fmt.Errorf("Expected %s, got %v", want, t)
+		}
+		return nil
+	}
+	if err := delim('{'); err != nil {
+		return n, err
+	}
+	seen := make(map[string]bool)
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return n, err
+		}
+		k := t.(string)
+		if seen[k] {
+			return n, fmt.Errorf("$: %s is duplicated", k)
+		}
+		seen[k] = true
+		p := s.Properties[k]
+		if k != "list" || p == nil || p.resolve(s).Items == nil {
+			var v interface{}
+			if err := dec.Decode(&v); err != nil {
+				return n, err
+			}
+			if err := s.validateProperty(s, k, v, "$"); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if err := delim('['); err != nil {
+			return n, fmt.Errorf("$.list: %s", err.Error())
+		}
+		items := p.resolve(s).Items
+		for dec.More() {
+			var v interface{}
+			if err := dec.Decode(&v); err != nil {
+				return n, err
+			}
+			if err := items.Validate(s, v, fmt.Sprintf("$.list[%d]", n)); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if err := delim(']'); err != nil {
+			return n, err
+		}
+	}
+	if err := delim('}'); err != nil {
+		return n, err
+	}
+	for _, k := range s.Required {
+		if !seen[k] {
+			return n, fmt.Errorf("$: %s is required", k)
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return n, fmt.Errorf("Data after the end of the document")
+	}
+	return n, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testSchema(t *testing.T) *TSchema {
+	t.Helper()
+	schema, err := ParseSchema(ResultSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+func TestValidateCompact(t *testing.T) {
+	schema := testSchema(t)
+	for _, n := range []int{0, 1, 5} {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, testResult(t, CResultJson, _DEFAULT_VERSION_, n, false)); err != nil {
+			t.Fatal(err)
+		}
+		for _, dat := range [][]byte{buf.Bytes(), append(buf.Bytes(), '\n')} {
+			if _n, err := ValidateResult(bytes.NewReader(dat), schema); err != nil || _n != n {
+				t.Errorf("compact %d: %d entries %v\n%s", n, _n, err, dat)
+			}
+		}
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	schema := testSchema(t)
+	lines := strings.Split(strings.TrimSpace(string(testResult(t, CResultJsonl, _DEFAULT_VERSION_, 2, false))), "\n")
+	doc := string(testResult(t, CResultJson, _DEFAULT_VERSION_, 2, false))
+	for name, dat := range map[string]string{
+		"no stat":         strings.Join(lines[:3], "\n"),
+		"after stat":      strings.Join(append(lines, lines[1]), "\n"),
+		"header key":      strings.Replace(strings.Join(lines, "\n"), `"v":`, `"x":1,"v":`, 1),
+		"header only":     lines[0],
+		"bad entry":       strings.Join([]string{lines[0], `{"d":"x.example","vd":"bogus"}`, lines[3]}, "\n"),
+		"document stat":   strings.Replace(doc, `"stat"`, `"stats"`, 1),
+		"document entry":  strings.Replace(doc, `"d": "d1.example"`, `"d": 1`, 1),
+		"document broken": doc[:len(doc)/2],
+	} {
+		if _, err := ValidateResult(strings.NewReader(dat), schema); err == nil {
+			t.Errorf("%s: no error\n%s", name, dat)
+		}
+	}
+}
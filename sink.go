@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TSink posts the stat and/or the snapshot of every pass to HTTP
+// endpoints. The deliveries are spooled and sent by a worker in the
+// background, oldest first. One that still fails after the retries stays
+// in the spool and is tried again at the next pass, with the ones behind
+// it.
+type TSink struct {
+	StatURL     string
+	SnapshotURL string
+	Key         string
+	Retries     uint
+	Backoff     time.Duration
+	Timeout     time.Duration
+	Spool       string
+	wake        chan struct{}
+	once        sync.Once
+	done        chan struct{}
+}
+
+// sinkSpoolMu serializes the replays of the spool, the sink of a reloaded
+// config works on the same directory as the old one.
+var sinkSpoolMu sync.Mutex
+
+// TSinkStat is the body posted to the stat endpoint.
+type TSinkStat struct {
+	Name     string        `json:"name,omitempty"`
+	T        int64         `json:"t"`
+	File     string        `json:"file"`
+	Header   *TDumpAnswer  `json:"h"`
+	Manifest *TManifest    `json:"manifest,omitempty"`
+	Stat     *TResolveStat `json:"stat"`
+}
+
+// TSinkRequest is a delivery, as kept in the spool next to its body. The
+// body of a snapshot is not copied, File refers to it in the results.
+type TSinkRequest struct {
+	URL         string            `json:"url"`
+	ContentType string            `json:"type"`
+	Header      map[string]string `json:"header,omitempty"`
+	File        string            `json:"file,omitempty"`
+}
+
+type sinkError struct {
+	code int
+}
+
+func (e *sinkError) Error() string {
+	return fmt.Sprintf("HTTP code %d", e.code)
+}
+
+// rejected tells a client error, the delivery is dropped as a retry won't
+// help.
+func rejected(err error) bool {
+	e, ok := err.(*sinkError)
+	return ok && e.code >= 400 && e.code < 500 && e.code != http.StatusTooManyRequests
+}
+
+func (s *TSink) Enabled() bool {
+	return s != nil && (s.StatURL != "" || s.SnapshotURL != "")
+}
+
+// post sends the request once, body is opened again on every attempt.
+func (s *TSink) post(req TSinkRequest, body func() (io.ReadCloser, error)) error {
+	r, err := body()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_req, err := http.NewRequest("POST", req.URL, r)
+	if err != nil {
+		return err
+	}
+	_req.Header.Set("Content-Type", req.ContentType)
+	for k, v := range req.Header {
+		_req.Header.Set(k, v)
+	}
+	if s.Key != "" {
+		_req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.Key))
+	}
+	client := &http.Client{Timeout: s.Timeout}
+	resp, err := client.Do(_req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &sinkError{resp.StatusCode}
+	}
+	return nil
+}
+
+// send posts with retries, client errors other than 429 are not retried.
+func (s *TSink) send(req TSinkRequest, body func() (io.ReadCloser, error)) error {
+	var err error
+	for i := uint(0); i <= s.Retries; i++ {
+		if i > 0 {
+			time.Sleep(s.Backoff << (i - 1))
+		}
+		if err = s.post(req, body); err == nil {
+			return nil
+		}
+		if rejected(err) {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Error: Sink %s attempt %d: %s\n", req.URL, i+1, err.Error())
+	}
+	return err
+}
+
+func fileBody(filename string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return os.Open(filename)
+	}
+}
+
+func bytesBody(dat []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(dat)), nil
+	}
+}
+
+// spool keeps a delivery as <name>.json and <name>.body, or only the
+// former when it refers to a file.
+func (s *TSink) spool(name string, req TSinkRequest, body func() (io.ReadCloser, error)) error {
+	if s.Spool == "" {
+		return fmt.Errorf("No spool directory, delivery dropped")
+	}
+	if err := os.MkdirAll(s.Spool, 0755); err != nil {
+		return err
+	}
+	base := filepath.Join(s.Spool, name)
+	if req.File != "" {
+		return s.spoolMeta(base, req)
+	}
+	r, err := body()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(base + ".body.tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, r); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if _, err = commitFile(f, base+".body"); err != nil {
+		return err
+	}
+	return s.spoolMeta(base, req)
+}
+
+func (s *TSink) spoolMeta(base string, req TSinkRequest) error {
+	dat, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return writeLines(base+".json", func(w *bufio.Writer) {
+		w.Write(dat)
+	})
+}
+
+// Replay sends the spooled deliveries, it stops at the first one that
+// still fails.
+func (s *TSink) Replay() error {
+	if s.Spool == "" {
+		return nil
+	}
+	list, err := filepath.Glob(filepath.Join(s.Spool, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(list)
+	for _, meta := range list {
+		dat, err := ioutil.ReadFile(meta)
+		if err != nil {
+			return err
+		}
+		var req TSinkRequest
+		if err := json.Unmarshal(dat, &req); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Sink spool %s: %s\n", meta, err.Error())
+			continue
+		}
+		base := strings.TrimSuffix(meta, ".json")
+		body := fileBody(base + ".body")
+		if req.File != "" {
+			body = fileBody(req.File)
+		}
+		if _, err := os.Stat(req.File); req.File != "" && os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Error: Sink dropped %s, %s is removed\n", filepath.Base(base), req.File)
+		} else if err := s.send(req, body); err != nil && !rejected(err) {
+			return err
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Sink %s rejected %s: %s\n", req.URL, filepath.Base(base), err.Error())
+		} else {
+			fmt.Printf("Sink: delivered %s\n", filepath.Base(base))
+		}
+		os.Remove(meta)
+		os.Remove(base + ".body")
+	}
+	return nil
+}
+
+// run replays the spool every time it is woken up, until Stop.
+func (s *TSink) run(wake, done chan struct{}) {
+	defer close(done)
+	for range wake {
+		sinkSpoolMu.Lock()
+		if err := s.Replay(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Sink spool: %s\n", err.Error())
+		}
+		sinkSpoolMu.Unlock()
+	}
+}
+
+// Stop ends the worker after the replay in progress, without waiting for
+// it. Deliver only spools from then on, for the sink that replaces it.
+func (s *TSink) Stop() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {})
+	if s.wake != nil {
+		close(s.wake)
+		s.wake = nil
+	}
+}
+
+// Deliver queues the results of a pass behind the spool and returns, the
+// worker sends them. Without a spool directory they are sent once in the
+// background, in no particular order.
+func (s *TSink) Deliver(st *TSinkStat, seqfile string) {
+	if !s.Enabled() {
+		return
+	}
+	base := strings.TrimSuffix(filepath.Base(seqfile), ".gz")
+	type item struct {
+		name string
+		req  TSinkRequest
+		body func() (io.ReadCloser, error)
+	}
+	var items []item
+	// In the order of the names, the worker may replay while the later
+	// ones are being spooled.
+	if s.SnapshotURL != "" {
+		req := TSinkRequest{URL: s.SnapshotURL, ContentType: "application/gzip",
+			Header: map[string]string{"X-Rvz-File": filepath.Base(seqfile)}, File: seqfile}
+		if st.Manifest != nil {
+			req.Header["X-Rvz-Sha256"] = st.Manifest.Sha256
+		}
+		items = append(items, item{base + ".snapshot", req, fileBody(seqfile)})
+	}
+	if s.StatURL != "" {
+		dat, err := json.Marshal(st)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Sink: %s\n", err.Error())
+		} else {
+			items = append(items, item{base + ".stat", TSinkRequest{URL: s.StatURL, ContentType: "application/json"}, bytesBody(dat)})
+		}
+	}
+	if s.Spool == "" {
+		go func() {
+			for _, it := range items {
+				if err := s.send(it.req, it.body); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: Sink %s failed, %s dropped: %s\n", it.req.URL, it.name, err.Error())
+				}
+			}
+		}()
+		return
+	}
+	for _, it := range items {
+		if err := s.spool(it.name, it.req, it.body); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Sink can't spool %s: %s\n", it.name, err.Error())
+		}
+	}
+	s.once.Do(func() {
+		s.wake = make(chan struct{}, 1)
+		s.done = make(chan struct{})
+		go s.run(s.wake, s.done)
+	})
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
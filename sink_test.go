@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tsinkServer answers with the queued codes, then with 200, and keeps the
+// deliveries it accepted.
+type tsinkServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	codes []int
+	hits  int
+	got   []string
+}
+
+func newSinkServer(t *testing.T, codes ...int) *tsinkServer {
+	srv := &tsinkServer{codes: codes}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		srv.hits++
+		if len(srv.codes) > 0 {
+			code := srv.codes[0]
+			srv.codes = srv.codes[1:]
+			if code != http.StatusOK {
+				w.WriteHeader(code)
+				return
+			}
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("%s: authorization %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		switch r.URL.Path {
+		case "/stat":
+			var st TSinkStat
+			if err := json.Unmarshal(body, &st); err != nil || r.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("stat body %s: %v", body, err)
+			}
+			srv.got = append(srv.got, "stat "+st.File)
+		case "/snapshot":
+			if string(body) != "gz of "+r.Header.Get("X-Rvz-File") || r.Header.Get("Content-Type") != "application/gzip" {
+				t.Errorf("snapshot %s body %q", r.Header.Get("X-Rvz-File"), body)
+			}
+			srv.got = append(srv.got, "snapshot "+r.Header.Get("X-Rvz-File"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// fail makes the server answer code until ok.
+func (srv *tsinkServer) fail(code int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.codes = make([]int, 1000)
+	for i := range srv.codes {
+		srv.codes[i] = code
+	}
+}
+
+func (srv *tsinkServer) ok() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.codes = nil
+}
+
+func (srv *tsinkServer) result() (int, []string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.hits, append([]string{}, srv.got...)
+}
+
+func testSink(srv *tsinkServer, spool string) *TSink {
+	return &TSink{
+		StatURL:     srv.URL + "/stat",
+		SnapshotURL: srv.URL + "/snapshot",
+		Key:         "secret",
+		Retries:     2,
+		Backoff:     time.Millisecond,
+		Timeout:     5 * time.Second,
+		Spool:       spool,
+	}
+}
+
+// testSnapshot writes the snapshot of the pass at t into dir.
+func testSnapshot(t *testing.T, dir string, ts int64) (*TSinkStat, string) {
+	t.Helper()
+	name := fmt.Sprintf("%d.gz", ts)
+	seqfile := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(seqfile, []byte("gz of "+name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &TSinkStat{T: ts, File: name, Stat: &TResolveStat{Domains: 1}}, seqfile
+}
+
+// wait stops the worker and waits for its last replay.
+func (s *TSink) wait() {
+	done := s.done
+	s.Stop()
+	if done != nil {
+		<-done
+	}
+}
+
+func TestSinkRetry(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		codes []int
+		hits  int
+		err   bool
+	}{
+		{"5xx", []int{500, 503}, 3, false},
+		{"429", []int{429}, 2, false},
+		{"4xx", []int{400}, 1, true},
+		{"404", []int{404, 500}, 1, true},
+		{"exhausted", []int{500, 502, 503}, 3, true},
+		{"429 exhausted", []int{429, 429, 429}, 3, true},
+	} {
+		srv := newSinkServer(t, c.codes...)
+		s := testSink(srv, "")
+		err := s.send(TSinkRequest{URL: s.StatURL, ContentType: "application/json"}, bytesBody([]byte(`{"file":"x"}`)))
+		if hits, _ := srv.result(); hits != c.hits || (err != nil) != c.err {
+			t.Errorf("%s: %d hits, error %v", c.name, hits, err)
+		}
+		if c.name == "4xx" && !rejected(err) {
+			t.Errorf("%s: %v is not rejected", c.name, err)
+		}
+		if c.name == "429 exhausted" && rejected(err) {
+			t.Errorf("%s: %v is rejected", c.name, err)
+		}
+	}
+}
+
+func TestSinkOrder(t *testing.T) {
+	dir := t.TempDir()
+	spool := filepath.Join(dir, "spool")
+	srv := newSinkServer(t)
+	srv.fail(http.StatusServiceUnavailable)
+	s := testSink(srv, spool)
+	for ts := int64(1700000001); ts <= 1700000002; ts++ {
+		st, seqfile := testSnapshot(t, dir, ts)
+		s.Deliver(st, seqfile)
+	}
+	srv.ok()
+	st, seqfile := testSnapshot(t, dir, 1700000003)
+	s.Deliver(st, seqfile)
+	s.wait()
+	_, got := srv.result()
+	var want []string
+	for ts := 1700000001; ts <= 1700000003; ts++ {
+		want = append(want, fmt.Sprintf("snapshot %d.gz", ts), fmt.Sprintf("stat %d.gz", ts))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+	if files, _ := ioutil.ReadDir(spool); len(files) != 0 {
+		t.Errorf("%d files left in the spool", len(files))
+	}
+}
+
+func TestSinkSpool(t *testing.T) {
+	dir := t.TempDir()
+	spool := filepath.Join(dir, "spool")
+	srv := newSinkServer(t)
+	srv.fail(http.StatusBadGateway)
+	s := testSink(srv, spool)
+	st, seqfile := testSnapshot(t, dir, 1700000001)
+	s.Deliver(st, seqfile)
+	s.wait()
+	// The snapshot is spooled as a reference, only the stat has a body.
+	var names []string
+	files, _ := ioutil.ReadDir(spool)
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	want := []string{"1700000001.snapshot.json", "1700000001.stat.body", "1700000001.stat.json"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("spool %v, want %v", names, want)
+	}
+
+	// A snapshot removed meanwhile is dropped and does not hold the
+	// spool.
+	os.Remove(seqfile)
+	srv.ok()
+	s = testSink(srv, spool)
+	st, seqfile = testSnapshot(t, dir, 1700000002)
+	s.Deliver(st, seqfile)
+	s.wait()
+	_, got := srv.result()
+	want = []string{"stat 1700000001.gz", "snapshot 1700000002.gz", "stat 1700000002.gz"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+}
+
+func TestSinkRejected(t *testing.T) {
+	dir := t.TempDir()
+	spool := filepath.Join(dir, "spool")
+	srv := newSinkServer(t, http.StatusBadRequest)
+	s := testSink(srv, spool)
+	s.SnapshotURL = ""
+	st, seqfile := testSnapshot(t, dir, 1700000001)
+	s.Deliver(st, seqfile)
+	st, seqfile = testSnapshot(t, dir, 1700000002)
+	s.Deliver(st, seqfile)
+	s.wait()
+	if hits, got := srv.result(); hits != 2 || !reflect.DeepEqual(got, []string{"stat 1700000002.gz"}) {
+		t.Errorf("%d hits, delivered %q", hits, got)
+	}
+	if files, _ := ioutil.ReadDir(spool); len(files) != 0 {
+		t.Errorf("%d files left in the spool", len(files))
+	}
+}
+
+func TestSinkNonBlocking(t *testing.T) {
+	dir := t.TempDir()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	s := &TSink{StatURL: srv.URL, Timeout: 5 * time.Second, Spool: filepath.Join(dir, "spool")}
+	start := time.Now()
+	st, seqfile := testSnapshot(t, dir, 1700000001)
+	s.Deliver(st, seqfile)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Deliver blocked for %s", d)
+	}
+	s.Stop()
+}
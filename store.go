@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The store keeps a change log of the answers of every domain and the
+// first/last time each address was seen for it:
+//
+//	obs:  domain \x00 ts -> TObservation (only when the answer changed)
+//	last: domain -> ts of the latest observation
+//	ips:  domain \x00 ip -> TSeen
+//	byip: ip \x00 domain -> nothing
+var (
+	bucketObs  = []byte("obs")
+	bucketLast = []byte("last")
+	bucketIps  = []byte("ips")
+	bucketByIp = []byte("byip")
+)
+
+const CStoreBatch = 1000
+
+// storeLockTimeout is how long Save waits for a query holding the file.
+var storeLockTimeout = 5 * time.Second
+
+type TObservation struct {
+	T     int64    `json:"t"`
+	Ip4   []string `json:"ip4,omitempty"`
+	Ip6   []string `json:"ip6,omitempty"`
+	Rcode string   `json:"rc,omitempty"`
+	Error bool     `json:"err,omitempty"`
+	Cname []string `json:"cn,omitempty"`
+}
+
+type TSeen struct {
+	First int64 `json:"first"`
+	Last  int64 `json:"last"`
+}
+
+type TStore struct {
+	db      *bolt.DB
+	file    string
+	t       int64
+	pending []TStoreItem
+}
+
+type TStoreItem struct {
+	Domain string
+	Obs    TObservation
+}
+
+func OpenStore(filename string, readonly bool) (*TStore, error) {
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: storeLockTimeout, ReadOnly: readonly})
+	if err != nil {
+		return nil, err
+	}
+	s := &TStore{db: db, t: time.Now().Unix()}
+	if readonly {
+		return s, nil
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketObs, bucketLast, bucketIps, bucketByIp} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewStore returns a store queueing the results of the passes, the file is
+// opened only by Save so that queries can read it during a pass.
+func NewStore(filename string) *TStore {
+	return &TStore{file: filename, t: time.Now().Unix()}
+}
+
+// Begin sets the time the results of a pass are recorded with.
+func (s *TStore) Begin(t int64) {
+	if s != nil {
+		s.t = t
+	}
+}
+
+// Pending is the number of results not saved yet.
+func (s *TStore) Pending() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.pending)
+}
+
+// requeue takes the results the store of the config before a reload
+// couldn't save, they go first.
+func (s *TStore) requeue(old *TStore) {
+	if s != nil && old != nil && old != s {
+		s.pending = append(old.pending, s.pending...)
+		old.pending = nil
+	}
+}
+
+func (s *TStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func storeKey(a, b string) []byte {
+	return []byte(a + "\x00" + b)
+}
+
+func storeTs(t int64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t))
+	return string(b[:])
+}
+
+func observation(dinfo *TDomainInfo, t int64) TObservation {
+	o := TObservation{T: t, Rcode: dinfo.Rcode, Error: dinfo.Error}
+	o.Ip4 = append(o.Ip4, dinfo.Ip4...)
+	o.Ip6 = append(o.Ip6, dinfo.Ip6...)
+	sort.Strings(o.Ip4)
+	sort.Strings(o.Ip6)
+	for c := dinfo.Cname; c != nil; c = c.Cname {
+		o.Cname = append(o.Cname, c.Domain)
+	}
+	return o
+}
+
+func sameObservation(a, b TObservation) bool {
+	a.T, b.T = 0, 0
+	_a, _ := json.Marshal(a)
+	_b, _ := json.Marshal(b)
+	return bytes.Equal(_a, _b)
+}
+
+// Record queues the result of a domain until Save.
+func (s *TStore) Record(dinfo *TDomainInfo) {
+	if s == nil || dinfo.Allowed {
+		return
+	}
+	s.pending = append(s.pending, TStoreItem{dinfo.Domain, observation(dinfo, s.t)})
+}
+
+// Save opens the store, writes the queued results in batches, expires
+// what was not seen since before (0 keeps everything) and closes it. The
+// results not written stay queued for the next Save.
+func (s *TStore) Save(before int64) error {
+	if s == nil {
+		return nil
+	}
+	db, err := OpenStore(s.file, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for len(s.pending) > 0 {
+		n := len(s.pending)
+		if n > CStoreBatch {
+			n = CStoreBatch
+		}
+		if err = db.write(s.pending[:n]); err != nil {
+			return err
+		}
+		s.pending = s.pending[n:]
+	}
+	if before > 0 {
+		return db.Expire(before)
+	}
+	return nil
+}
+
+// write stores the results: a new observation when the answer changed,
+// and the seen times of the addresses.
+func (s *TStore) write(items []TStoreItem) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		obs, last, ips, byip := tx.Bucket(bucketObs), tx.Bucket(bucketLast), tx.Bucket(bucketIps), tx.Bucket(bucketByIp)
+		for _, item := range items {
+			o := item.Obs
+			changed := true
+			if _t := last.Get([]byte(item.Domain)); _t != nil {
+				var prev TObservation
+				if json.Unmarshal(obs.Get(storeKey(item.Domain, string(_t))), &prev) == nil {
+					changed = !sameObservation(prev, o)
+				}
+			}
+			if changed {
+				dat, err := json.Marshal(o)
+				if err != nil {
+					return err
+				}
+				if err = obs.Put(storeKey(item.Domain, storeTs(o.T)), dat); err != nil {
+					return err
+				}
+				if err = last.Put([]byte(item.Domain), []byte(storeTs(o.T))); err != nil {
+					return err
+				}
+			}
+			for _, ip := range append(append([]string{}, o.Ip4...), o.Ip6...) {
+				seen := TSeen{First: o.T, Last: o.T}
+				k := storeKey(item.Domain, ip)
+				if v := ips.Get(k); v != nil {
+					var _seen TSeen
+					if json.Unmarshal(v, &_seen) == nil {
+						seen.First = _seen.First
+					}
+				}
+				dat, _ := json.Marshal(seen)
+				if err := ips.Put(k, dat); err != nil {
+					return err
+				}
+				if err := byip.Put(storeKey(ip, item.Domain), []byte{}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Expire removes the observations and addresses not seen since before,
+// the latest observation of a domain is always kept.
+func (s *TStore) Expire(before int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		obs, last, ips, byip := tx.Bucket(bucketObs), tx.Bucket(bucketLast), tx.Bucket(bucketIps), tx.Bucket(bucketByIp)
+		var dels [][]byte
+		c := obs.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			i := bytes.IndexByte(k, 0)
+			if i < 0 || len(k)-i-1 != 8 {
+				continue
+			}
+			t := int64(binary.BigEndian.Uint64(k[i+1:]))
+			if t >= before || bytes.Equal(last.Get(k[:i]), k[i+1:]) {
+				continue
+			}
+			dels = append(dels, append([]byte{}, k...))
+		}
+		for _, k := range dels {
+			if err := obs.Delete(k); err != nil {
+				return err
+			}
+		}
+		dels = dels[:0]
+		c = ips.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var seen TSeen
+			if json.Unmarshal(v, &seen) == nil && seen.Last < before {
+				dels = append(dels, append([]byte{}, k...))
+			}
+		}
+		for _, k := range dels {
+			if err := ips.Delete(k); err != nil {
+				return err
+			}
+			parts := strings.SplitN(string(k), "\x00", 2)
+			if err := byip.Delete(storeKey(parts[1], parts[0])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// History returns the observations of the domain between from and to
+// (unix time, 0 is open), including the one in effect at from.
+func (s *TStore) History(domain string, from, to int64) ([]TObservation, error) {
+	var list []TObservation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_b := tx.Bucket(bucketObs)
+		if _b == nil {
+			return nil
+		}
+		c := _b.Cursor()
+		prefix := []byte(domain + "\x00")
+		var prev *TObservation
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var o TObservation
+			if err := json.Unmarshal(v, &o); err != nil {
+				return err
+			}
+			if to > 0 && o.T > to {
+				break
+			}
+			if o.T < from {
+				prev = &o
+				continue
+			}
+			list = append(list, o)
+		}
+		if prev != nil {
+			list = append([]TObservation{*prev}, list...)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// Seen returns the addresses of the domain with their first/last seen.
+func (s *TStore) Seen(domain string) (map[string]TSeen, error) {
+	res := make(map[string]TSeen)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_b := tx.Bucket(bucketIps)
+		if _b == nil {
+			return nil
+		}
+		c := _b.Cursor()
+		prefix := []byte(domain + "\x00")
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var seen TSeen
+			if err := json.Unmarshal(v, &seen); err != nil {
+				return err
+			}
+			res[string(k[len(prefix):])] = seen
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Domains returns the domains ever seen resolving to the address.
+func (s *TStore) Domains(ip string) ([]string, error) {
+	var list []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_b := tx.Bucket(bucketByIp)
+		if _b == nil {
+			return nil
+		}
+		c := _b.Cursor()
+		prefix := []byte(ip + "\x00")
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			list = append(list, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	return list, err
+}
+
+// ParseTime reads a unix time, a date or an RFC 3339 time.
+func ParseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if t, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("Not valid time: %s", s)
+	}
+	return t.Unix(), nil
+}
+
+func formatTime(t int64) string {
+	return time.Unix(t, 0).Format(time.RFC3339)
+}
+
+// StoreQuery prints the history of a domain or the domains of an address.
+func StoreQuery(filename, domain, ip string, from, to int64) error {
+	s, err := OpenStore(filename, true)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if ip != "" {
+		list, err := s.Domains(ip)
+		if err != nil {
+			return err
+		}
+		for _, d := range list {
+			seen, err := s.Seen(d)
+			if err != nil {
+				return err
+			}
+			_s := seen[ip]
+			if (from > 0 && _s.Last < from) || (to > 0 && _s.First > to) {
+				continue
+			}
+			fmt.Printf("%s\t%s\t%s\n", d, formatTime(_s.First), formatTime(_s.Last))
+		}
+		return nil
+	}
+	if domain == "" {
+		return fmt.Errorf("Domain or IP is required")
+	}
+	list, err := s.History(domain, from, to)
+	if err != nil {
+		return err
+	}
+	for _, o := range list {
+		_ips := append(append([]string{}, o.Ip4...), o.Ip6...)
+		fmt.Printf("%s\t%s", formatTime(o.T), strings.Join(_ips, ","))
+		if o.Rcode != "" {
+			fmt.Printf("\t%s", o.Rcode)
+		}
+		if o.Error {
+			fmt.Print("\terror")
+		}
+		if len(o.Cname) > 0 {
+			fmt.Printf("\tcname:%s", strings.Join(o.Cname, ">"))
+		}
+		fmt.Print("\n")
+	}
+	seen, err := s.Seen(domain)
+	if err != nil {
+		return err
+	}
+	_ips := make([]string, 0, len(seen))
+	for ip := range seen {
+		_ips = append(_ips, ip)
+	}
+	sort.Strings(_ips)
+	for _, ip := range _ips {
+		fmt.Printf("seen\t%s\t%s\t%s\n", ip, formatTime(seen[ip].First), formatTime(seen[ip].Last))
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testPass(t *testing.T, file string, ts int64, results map[string][]string) *TStore {
+	t.Helper()
+	s := NewStore(file)
+	s.t = ts
+	for domain, ips := range results {
+		dinfo := NewDomainInfo(domain)
+		dinfo.Ip4 = ips
+		s.Record(dinfo)
+	}
+	return s
+}
+
+func TestStoreSave(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.db")
+	if err := testPass(t, file, 1000, map[string][]string{
+		"a.example": {"192.0.2.1"},
+		"b.example": {"192.0.2.1"},
+	}).Save(0); err != nil {
+		t.Fatal(err)
+	}
+	s := testPass(t, file, 2000, map[string][]string{
+		"a.example": {"192.0.2.2"},
+		"b.example": {"192.0.2.1"},
+	})
+	// The pass does not hold the store, queries can read it meanwhile.
+	r, err := OpenStore(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if err := s.Save(0); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = OpenStore(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for domain, n := range map[string]int{"a.example": 2, "b.example": 1} {
+		list, err := r.History(domain, 0, 0)
+		if err != nil || len(list) != n {
+			t.Errorf("%s: %d observations %v, want %d", domain, len(list), err, n)
+		}
+	}
+	seen, err := r.Seen("a.example")
+	if err != nil || seen["192.0.2.1"] != (TSeen{1000, 1000}) || seen["192.0.2.2"] != (TSeen{2000, 2000}) {
+		t.Errorf("seen %v %v", seen, err)
+	}
+	seen, _ = r.Seen("b.example")
+	if seen["192.0.2.1"] != (TSeen{1000, 2000}) {
+		t.Errorf("seen %v", seen)
+	}
+	if list, _ := r.Domains("192.0.2.1"); len(list) != 2 {
+		t.Errorf("domains of 192.0.2.1: %v", list)
+	}
+}
+
+func TestStoreExpire(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.db")
+	testPass(t, file, 1000, map[string][]string{"a.example": {"192.0.2.1"}}).Save(0)
+	testPass(t, file, 2000, map[string][]string{"a.example": {"192.0.2.2"}}).Save(0)
+	if err := testPass(t, file, 3000, map[string][]string{"a.example": {"192.0.2.2"}}).Save(1500); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenStore(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if list, _ := r.History("a.example", 0, 0); len(list) != 1 || list[0].T != 2000 {
+		t.Errorf("history %v", list)
+	}
+	if seen, _ := r.Seen("a.example"); len(seen) != 1 || seen["192.0.2.2"] != (TSeen{2000, 3000}) {
+		t.Errorf("seen %v", seen)
+	}
+	if list, _ := r.Domains("192.0.2.1"); len(list) != 0 {
+		t.Errorf("domains of an expired address: %v", list)
+	}
+}
+
+func TestStoreRetry(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.db")
+	defer func(d time.Duration) { storeLockTimeout = d }(storeLockTimeout)
+	if err := testPass(t, file, 500, map[string][]string{"a.example": {"192.0.2.1"}}).Save(0); err != nil {
+		t.Fatal(err)
+	}
+	// A query holds the file, the pass keeps its results.
+	r, err := OpenStore(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeLockTimeout = 50 * time.Millisecond
+	s := testPass(t, file, 1000, map[string][]string{"a.example": {"192.0.2.1"}, "b.example": {"192.0.2.1"}})
+	if err := s.Save(0); err == nil || s.Pending() != 2 {
+		t.Fatalf("save while held: %d pending, %v", s.Pending(), err)
+	}
+	r.Close()
+
+	// The next pass, after a reload, saves both.
+	next := NewStore(file)
+	next.requeue(s)
+	next.Begin(2000)
+	dinfo := NewDomainInfo("a.example")
+	dinfo.Ip4 = []string{"192.0.2.2"}
+	next.Record(dinfo)
+	if err := next.Save(0); err != nil || next.Pending() != 0 {
+		t.Fatalf("save: %d pending, %v", next.Pending(), err)
+	}
+	r, err = OpenStore(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	list, _ := r.History("a.example", 0, 0)
+	if len(list) != 2 || list[0].T+list[1].T != 2500 {
+		t.Errorf("history of a.example %v", list)
+	}
+	if seen, _ := r.Seen("a.example"); seen["192.0.2.1"] != (TSeen{500, 1000}) || seen["192.0.2.2"] != (TSeen{2000, 2000}) {
+		t.Errorf("seen %v", seen)
+	}
+	if seen, _ := r.Seen("b.example"); seen["192.0.2.1"] != (TSeen{1000, 1000}) {
+		t.Errorf("seen %v", seen)
+	}
+}
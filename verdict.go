@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+const (
+	CVerdictClean     string = "clean"
+	CVerdictSinkhole  string = "sinkholed"
+	CVerdictNxInject  string = "nx_injected"
+	CVerdictDivergent string = "divergent"
+)
+
+// TStubs are the known stub and sinkhole addresses the blocked domains are
+// pointed to.
+type TStubs struct {
+	nets []netip.Prefix
+}
+
+// ReadStubs reads the stub list: the addresses or CIDRs of list and of the
+// file, one per line, # starts a comment.
+func ReadStubs(filename string, list []string) (*TStubs, error) {
+	s := &TStubs{}
+	var err error
+	if s.nets, err = ParsePrefixes(list); err != nil {
+		return nil, err
+	}
+	if filename == "" {
+		return s, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		p, err := ParsePrefixes([]string{line})
+		if err != nil {
+			return nil, fmt.Errorf("Stub list line %d invalid: %s (%s)", l, line, err.Error())
+		}
+		s.nets = append(s.nets, p...)
+	}
+	return s, scanner.Err()
+}
+
+func (s *TStubs) Match(ip string) bool {
+	if s == nil {
+		return false
+	}
+	a, err := netip.ParseAddr(ip)
+	return err == nil && prefixesContain(s.nets, a.Unmap())
+}
+
+// verdictAddrs returns the addresses of the query types both profiles
+// ask, ref is nil without a trusted profile.
+func verdictAddrs(dinfo *TDomainInfo, p, ref *TProfile) []string {
+	var res []string
+	if ref == nil || (p.Query(dns.TypeA) && ref.Query(dns.TypeA)) {
+		res = append(res, dinfo.Ip4...)
+	}
+	if ref == nil || (p.Query(dns.TypeAAAA) && ref.Query(dns.TypeAAAA)) {
+		res = append(res, dinfo.Ip6...)
+	}
+	return res
+}
+
+// Verdict tells how the answer of profile p compares with the answer of
+// the trusted profile: a stub address is sinkholed, an NXDOMAIN the
+// trusted profile does not get is injected, another rcode or addresses
+// with none in common are divergent. trusted is nil for the trusted
+// profile itself, which is only checked for stubs. Domains failed on
+// either side get no verdict.
+func Verdict(dinfo *TDomainInfo, p *TProfile, trusted *TDomainInfo, tp *TProfile, stubs *TStubs) string {
+	if dinfo.Allowed || dinfo.Error || (trusted != nil && trusted.Error) {
+		return ""
+	}
+	if trusted == nil {
+		tp = nil
+	}
+	addrs := verdictAddrs(dinfo, p, tp)
+	for _, ip := range addrs {
+		if stubs.Match(ip) {
+			return CVerdictSinkhole
+		}
+	}
+	if trusted == nil {
+		return CVerdictClean
+	}
+	nx := dns.RcodeToString[dns.RcodeNameError]
+	if dinfo.Rcode == nx && trusted.Rcode == "" {
+		return CVerdictNxInject
+	}
+	if dinfo.Rcode != trusted.Rcode {
+		return CVerdictDivergent
+	}
+	_addrs := verdictAddrs(trusted, tp, p)
+	if len(addrs) == 0 || len(_addrs) == 0 {
+		if len(addrs) != len(_addrs) {
+			return CVerdictDivergent
+		}
+		return CVerdictClean
+	}
+	known := make(map[string]bool)
+	for _, ip := range _addrs {
+		known[ip] = true
+	}
+	for _, ip := range addrs {
+		if known[ip] {
+			return CVerdictClean
+		}
+	}
+	return CVerdictDivergent
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestVerdict(t *testing.T) {
+	stubs, err := ReadStubs("", []string{"192.0.2.0/24", "2001:db8:5::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	both := &TProfile{Qtypes: []uint16{dns.TypeA, dns.TypeAAAA}}
+	only4 := &TProfile{Qtypes: []uint16{dns.TypeA}}
+	answer := func(rcode string, ips ...string) *TDomainInfo {
+		dinfo := NewDomainInfo("a.example")
+		dinfo.Rcode = rcode
+		for _, ip := range ips {
+			if strings.Contains(ip, ".") {
+				dinfo.Ip4 = append(dinfo.Ip4, ip)
+			} else {
+				dinfo.Ip6 = append(dinfo.Ip6, ip)
+			}
+		}
+		return dinfo
+	}
+	allowed := answer("", "192.0.2.1")
+	allowed.Allowed = true
+	failed := answer("")
+	failed.Error = true
+	for _, c := range []struct {
+		name    string
+		dinfo   *TDomainInfo
+		p       *TProfile
+		trusted *TDomainInfo
+		want    string
+	}{
+		{"trusted clean", answer("", "198.51.100.1"), both, nil, CVerdictClean},
+		{"trusted stub", answer("", "198.51.100.1", "2001:db8:5::1"), both, nil, CVerdictSinkhole},
+		{"stub", answer("", "192.0.2.7"), both, answer("", "198.51.100.1"), CVerdictSinkhole},
+		{"common address", answer("", "198.51.100.1", "198.51.100.2"), both, answer("", "198.51.100.2"), CVerdictClean},
+		{"no common address", answer("", "198.51.100.1"), both, answer("", "198.51.100.2"), CVerdictDivergent},
+		{"no address", answer(""), both, answer("", "198.51.100.2"), CVerdictDivergent},
+		{"both without address", answer(""), both, answer(""), CVerdictClean},
+		{"nxdomain injected", answer("NXDOMAIN"), both, answer("", "198.51.100.2"), CVerdictNxInject},
+		{"both nxdomain", answer("NXDOMAIN"), both, answer("NXDOMAIN"), CVerdictClean},
+		{"other rcode", answer("SERVFAIL"), both, answer(""), CVerdictDivergent},
+		{"nxdomain against refused", answer("NXDOMAIN"), both, answer("REFUSED"), CVerdictDivergent},
+		// Only the query types both profiles ask are compared.
+		{"qtypes", answer("", "198.51.100.1"), only4, answer("", "198.51.100.1", "2001:db8::1"), CVerdictClean},
+		{"qtypes without address", answer(""), only4, answer("", "2001:db8::1"), CVerdictClean},
+		{"allowed", allowed, both, answer("", "198.51.100.2"), ""},
+		{"failed", failed, both, answer("", "198.51.100.2"), ""},
+		{"trusted failed", answer("", "198.51.100.1"), both, failed, ""},
+	} {
+		if got := Verdict(c.dinfo, c.p, c.trusted, both, stubs); got != c.want {
+			t.Errorf("%s: %q, want %q", c.name, got, c.want)
+		}
+	}
+}